@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"errors"
 	"log"
 	"os"
+	"rocked/utils"
 	"strconv"
+	"syscall"
+	"time"
 
 	"log/slog"
 )
@@ -75,6 +79,38 @@ func (c *Cgroup) CreateConCgroup() error {
 	return nil
 }
 
+// Removes the container cgroup directory.
+// The cgroup must not have any process left.
+func (c *Cgroup) Remove() error {
+	slog.Debug("Cgroup Remove", "CgroupConPath", c.CgroupConPath)
+	return os.Remove(c.CgroupConPath)
+}
+
+// Kills the processes left in the cgroup and removes it once they are gone.
+// When the container init exits the kernel kills the rest of the pid
+// namespace, but the processes may take a moment to leave the cgroup.
+func (c *Cgroup) RemoveWhenEmpty(timeout time.Duration) error {
+	slog.Debug("Cgroup RemoveWhenEmpty", "CgroupConPath", c.CgroupConPath, "timeout", timeout)
+	if !utils.PathExists(c.CgroupConPath) {
+		return nil
+	}
+	// cgroup.kill is available since Linux 5.14
+	if err := os.WriteFile(c.CgroupConPath+"/cgroup.kill", []byte("1"), 0644); err != nil {
+		slog.Debug("Cgroup RemoveWhenEmpty error writing cgroup.kill", "err", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := c.Remove()
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 // Return the file reference to be later used with the clone3 syscall
 func (c *Cgroup) GetCGFd() (*os.File, error) {
 	cgroupControlFile, err := os.Open(c.CgroupConPath)
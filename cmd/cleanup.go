@@ -0,0 +1,127 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"rocked/utils"
+	"syscall"
+	"time"
+
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	CGROUP_REMOVE_TIMEOUT = 5 * time.Second
+	autoRemove            bool
+)
+
+// Unmounts whatever is still mounted inside the container directory.
+// The overlay and the virtual file systems normally go away with the container
+// mount namespace, but a container which failed half way may have left some of
+// them behind.
+func umountContainer(path string) error {
+	mounts, err := utils.MountsUnder("/proc/self/mountinfo", path)
+	if err != nil {
+		return err
+	}
+	for _, target := range mounts {
+		if errno := Umount(target, syscall.MNT_DETACH); errno != 0 && errno != syscall.EINVAL && errno != syscall.ENOENT {
+			slog.Debug("umountContainer", "target", target, "error", errno)
+		}
+	}
+	mounts, err = utils.MountsUnder("/proc/self/mountinfo", path)
+	if err != nil {
+		return err
+	}
+	if len(mounts) != 0 {
+		return fmt.Errorf("%v are still mounted", mounts)
+	}
+	return nil
+}
+
+// CleanupContainer removes everything a stopped container leaves behind:
+// its mounts, its cgroup and its directory.
+// Every step is attempted even if the previous ones failed, but the directory
+// is only removed once nothing is mounted in it anymore, so a leftover /dev or
+// /sys mount can't be wiped through it.
+func CleanupContainer(state *State) error {
+	slog.Debug("CleanupContainer", "id", state.Id, "bundle", state.Bundle)
+	var errs []error
+	errm := umountContainer(state.Bundle)
+	if errm != nil {
+		errs = append(errs, fmt.Errorf("unmounting: %w", errm))
+	}
+	if err := NewCgroup(state.Id).RemoveWhenEmpty(CGROUP_REMOVE_TIMEOUT); err != nil {
+		errs = append(errs, fmt.Errorf("removing the cgroup: %w", err))
+	}
+	if errm == nil {
+		if err := os.RemoveAll(state.Bundle); err != nil {
+			errs = append(errs, fmt.Errorf("removing the directory: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Cleans up after a container which just stopped: with --rm everything goes
+// away, otherwise only the cgroup is removed and the container can still be
+// inspected.
+func cleanupStopped(state *State) {
+	if state.AutoRemove {
+		if err := CleanupContainer(state); err != nil {
+			log.Printf("Error removing the container %v: %v", state.Id, err)
+		}
+		return
+	}
+	if err := NewCgroup(state.Id).RemoveWhenEmpty(CGROUP_REMOVE_TIMEOUT); err != nil {
+		log.Printf("Error removing the cgroup of the container %v: %v", state.Id, err)
+	}
+}
+
+// Removes the stopped containers, returning how many were removed
+func pruneContainers() int {
+	states, err := ListStates(base_path)
+	if err != nil {
+		log.Fatal("Error listing the containers: ", err)
+	}
+	removed := 0
+	for _, state := range states {
+		if state.Status != StatusStopped {
+			continue
+		}
+		if err := CleanupContainer(state); err != nil {
+			log.Printf("Error removing the container %v: %v", state.Id, err)
+			continue
+		}
+		fmt.Println(state.Id)
+		removed++
+	}
+	return removed
+}
+
+// containerCmd groups the commands managing containers
+var containerCmd = &cobra.Command{
+	Use:   "container",
+	Short: "Manages containers",
+}
+
+// containerPruneCmd represents the container prune command
+var containerPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Removes all the stopped containers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pruneContainers()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(containerCmd)
+	containerCmd.AddCommand(containerPruneCmd)
+}
@@ -1,11 +1,9 @@
 package cmd
 
 import (
-	"encoding/json"
-	"io"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"rocked/specs"
 	"rocked/utils"
 
@@ -42,11 +40,15 @@ func IsValidAlgorithm(algo string) bool {
 
 type Container struct {
 	Path          string
-	JsonPath      string
 	id            string
-	Index         specs.Index
 	ImageManifest specs.Manifest
 	Image         specs.Image
+	ImageRef      Reference
+	// The digest of the index entry ImageRef resolves to, not of the
+	// platform manifest: rmi and image prune match it
+	ImageDigest digest.Digest
+	// The unpacked image layers, from the bottom-most to the top-most
+	Layers []string
 }
 
 func NewContainer(path string) *Container {
@@ -56,138 +58,26 @@ func NewContainer(path string) *Container {
 	}
 	id := uuid.New().String()
 	cpath := path + id
-	jpath := cpath + "/index.json"
-	slog.Debug("Container: Initialising new container", "cpath", cpath, "JsonPath", jpath)
+	slog.Debug("Container: Initialising new container", "cpath", cpath)
 	return &Container{
-		id:       id,
-		Path:     cpath,
-		JsonPath: jpath,
+		id:   id,
+		Path: cpath,
 	}
 }
 
-func (c *Container) LoadConfigJson() error {
-	slog.Debug("Container: Loading index")
-	jsonconfig, err := os.Open(c.JsonPath)
-
-	if err != nil {
-		return err
-	}
-	defer jsonconfig.Close()
-	byteValue, _ := io.ReadAll(jsonconfig)
-	var index specs.Index
-	err = json.Unmarshal(byteValue, &index)
-	if err != nil {
-		return err
-	}
-	slog.Debug("Container: ", "index", index)
-	c.Index = index
-	return nil
-}
-
-func (c *Container) BlobExists(algo digest.Algorithm, digest string) bool {
-	digestPath := c.Path + "/blobs/" + algo.String() + "/" + digest
-	slog.Debug("Container: BlobExists", "digest path", digestPath)
-	_, err := os.Stat(digestPath)
-	if os.IsNotExist(err) {
-		slog.Debug("Container: BlobExists", "return", false)
-		return false
-	}
-	slog.Debug("Container: BlobExists", "return", true)
-	return true
-}
-
-func (c *Container) ReadImageManifest(manifest specs.Descriptor) error {
-	slog.Debug("Container: ReadImageManifest", "manifest", manifest)
-	if manifest.MediaType != "application/vnd.oci.image.manifest.v1+json" {
-		return &MediaTypeError{}
-	}
-	algo := string(manifest.Digest.Algorithm())
-	if !IsValidAlgorithm(algo) {
-		return &AlgorithmError{}
-	}
-	imagePath := c.Path + "/blobs/" + algo + "/" + string(manifest.Digest.Encoded())
-	slog.Debug("Container: ReadImageManifest", "imagePath", imagePath)
-	jsonblob, err := os.Open(imagePath)
-	if err != nil {
-		return err
-	}
-	defer jsonblob.Close()
-	byteValue, _ := io.ReadAll(jsonblob)
-	var image specs.Manifest
-	err = json.Unmarshal(byteValue, &image)
-	if err != nil {
-		return err
-	}
-	slog.Debug("Container: ", "image", image)
-	c.ImageManifest = image
-	return nil
-}
-
-func (c *Container) ReadImageConfig() error {
-	config := c.ImageManifest.Config
-	slog.Debug("Container: ReadImageConfig", "config", config)
-	if config.MediaType != "application/vnd.oci.image.config.v1+json" {
-		return &MediaTypeError{}
-	}
-	algo := string(config.Digest.Algorithm())
-	if !IsValidAlgorithm(algo) {
-		return &AlgorithmError{}
-	}
-	configPath := c.Path + "/blobs/" + algo + "/" + string(config.Digest.Encoded())
-	slog.Debug("Container: ReadImageConfig", "configPath", configPath)
-	jsonblob, err := os.Open(configPath)
-	if err != nil {
-		return err
-	}
-	defer jsonblob.Close()
-	byteValue, _ := io.ReadAll(jsonblob)
-	var configjson specs.Image
-	err = json.Unmarshal(byteValue, &configjson)
-	if err != nil {
-		return err
-	}
-	slog.Debug("Container: ", "config", configjson)
-	c.Image = configjson
-	return nil
-}
-
-func (c *Container) ExpandAllManifest(defaultContainerImage string) error {
-	slog.Debug("ExpandAllManifest", "defaultContainerImage", defaultContainerImage)
-	for _, manifest := range c.Index.Manifests {
-		exists := c.BlobExists(manifest.Digest.Algorithm(), manifest.Digest.Encoded())
-		if exists {
-			slog.Debug("setContainer", "manifest", manifest.Annotations["org.opencontainers.image.ref.name"], "exists", exists)
-			err := c.ReadImageManifest(manifest)
-			if err != nil {
-				return err
-			}
-			err = c.ReadImageConfig()
-			if err != nil {
-				return err
-			}
-
-			for _, layer := range c.ImageManifest.Layers {
-				// Extract the base layer into defaultContainerImage+"image_root"
-				layerPath := defaultContainerImage + "/blobs/" + string(layer.Digest.Algorithm()) + "/" + string(layer.Digest.Encoded())
-				slog.Debug("setContainer", "layer path", layerPath)
-				//utils.Gunzip(layerPath, "/home/plambri/tempunzipped")
-				containerImageRoot := defaultContainerImage + "/image_root"
-				if !utils.PathExists(containerImageRoot) {
-					os.Mkdir(containerImageRoot, 0770)
-				}
-				cmd := exec.Command("tar", "xvf", layerPath, "-C", containerImageRoot)
-				if err := cmd.Run(); err != nil {
-					log.Printf("Error while unpacking the layer %v: error %v", layerPath, err)
-					return err
-				}
-			}
-		}
+// LoadContainer returns the container with the given id, previously set up in path.
+func LoadContainer(path, id string) (*Container, error) {
+	slog.Debug("Container: Loading container", "path", path, "id", id)
+	cpath := path + id
+	if len(id) == 0 || !utils.PathExists(cpath) {
+		return nil, fmt.Errorf("container %v not found", id)
 	}
-	return nil
+	return &Container{
+		id:   id,
+		Path: cpath,
+	}, nil
 }
 
-func (c *Container) GetDigestPath() {}
-
 // Create the necessary directories (work, upper and merge) in <path>
 func CreateOverlayDirs(path string) error {
 	slog.Debug("createOverlayDirs", "path", path)
@@ -201,19 +91,69 @@ func CreateOverlayDirs(path string) error {
 	return nil
 }
 
-func SetContainer(image, base_path string) (*Container, error) {
-	slog.Debug("setContainert", "image", image, "base_path", base_path)
+// Sets up a new container in base_path for the image reference image.
+// The image is taken from the image store, where its layers are unpacked once
+// and shared by the containers as the overlay lower directories.
+// For a multi-platform image, the manifest for the platform (os/arch[/variant],
+// the host one if empty) is used.
+// It returns with the garbage collection of the store held off, released by
+// the returned function once the state of the container records its layers.
+func SetContainer(image, platform, base_path string) (*Container, func(), error) {
+	slog.Debug("setContainer", "image", image, "platform", platform, "base_path", base_path)
+	ref, err := ParseReference(image)
+	if err != nil {
+		return nil, nil, err
+	}
+	want, err := selectedPlatform(platform)
+	if err != nil {
+		return nil, nil, err
+	}
+	store := NewImageStore(IMAGE_STORE_PATH)
+	if err := store.Init(); err != nil {
+		return nil, nil, err
+	}
+	store.Progress = os.Stderr
+	// The layers aren't used by a container until its state is saved
+	unlock, err := store.lockBlobs()
+	if err != nil {
+		return nil, nil, err
+	}
+	con, err := newImageContainer(store, ref, want, base_path)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return con, unlock, nil
+}
+
+// Creates a container for the image ref of the store, unpacking its layers
+func newImageContainer(store *ImageStore, ref Reference, want specs.Platform, base_path string) (*Container, error) {
+	desc, err := store.Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
 	con := NewContainer(base_path)
-	var defaultSourceContainersImages string = "blobs/container_images/" + image + ".tar"
-	utils.ExtractImage(defaultSourceContainersImages, con.Path)
-	errcon := con.LoadConfigJson()
-	if errcon != nil {
-		return nil, errcon
-	}
-	slog.Debug("setContainert", "Manifests", con.Index.Manifests)
-	con.ExpandAllManifest(con.Path)
-	err := CreateOverlayDirs(con.Path)
+	con.ImageRef = ref
+	con.ImageDigest = desc.Digest
+	desc, err = store.ResolveManifest(desc, want)
+	if err != nil {
+		return nil, err
+	}
+	con.ImageManifest, err = store.ReadManifest(desc)
+	if err != nil {
+		return nil, err
+	}
+	con.Image, err = store.ReadConfig(con.ImageManifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	con.Layers, err = store.Unpack(con.ImageManifest, con.Image)
+	if err != nil {
+		return nil, err
+	}
+	err = CreateOverlayDirs(con.Path)
 	if err != nil {
+		os.RemoveAll(con.Path)
 		return nil, err
 	}
 	return con, nil
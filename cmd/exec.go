@@ -0,0 +1,188 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// Namespaces joined by exec, in order. The pid namespace is joined
+	// separately by the parent, as it only applies to its children.
+	EXEC_NAMESPACES = []struct {
+		name string
+		flag uint64
+	}{
+		{"ipc", CLONE_NEWIPC},
+		{"uts", CLONE_NEWUTS},
+		{"net", CLONE_NEWNET},
+		{"cgroup", CLONE_NEWCGROUP},
+		{"mnt", CLONE_NEWNS},
+	}
+)
+
+// Opens the namespace files of pid
+func openNamespaces(pid int) (int, []int, error) {
+	nsPath := "/proc/" + strconv.Itoa(pid) + "/ns/"
+	pidns, err := syscall.Open(nsPath+"pid", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, nil, err
+	}
+	var fds []int
+	for _, ns := range EXEC_NAMESPACES {
+		fd, err := syscall.Open(nsPath+ns.name, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return pidns, fds, nil
+}
+
+// execFork creates a new process inside the container of state.
+// The caller must have joined the container pid namespace for its children.
+// The child joins the other namespaces and executes the process described by
+// process, the parent gets its pid and pidfd.
+//
+//go:noinline
+//go:norace
+//go:nocheckptr
+func execFork(state, process *State, nsfds []int, ttySlave string, interactive bool) (int, int, syscall.Errno) {
+	slog.Debug("execFork", "id", state.Id, "pid", state.Pid, "args", process.Command)
+	cgFile, err := NewCgroup(state.Id).GetCGFd()
+	if err != nil {
+		log.Fatal("Error while getting the cgroup fd of the container ", state.Id, ": ", err)
+	}
+	defer cgFile.Close()
+	var pidfd int32 = -1
+	cargs := CloneArgs{
+		flags:  CLONE_VFORK | CLONE_INTO_CGROUP | CLONE_PIDFD,
+		cgroup: uint64(cgFile.Fd()),
+		pidFD:  uint64(uintptr(unsafe.Pointer(&pidfd))),
+	}
+	pid, errno := Fork(&cargs)
+	if errno != 0 {
+		return -1, -1, errno
+	}
+	//Parent
+	if pid != 0 {
+		return int(pid), int(pidfd), 0
+	}
+
+	// The terminal is opened before joining the container mount namespace
+	ttyfd := -1
+	if len(ttySlave) != 0 {
+		ttyfd, errno = Open(ttySlave, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC)
+		if errno != 0 {
+			log.Fatal("Error opening the terminal ", ttySlave, ": ", errno)
+		}
+	}
+	for i, ns := range EXEC_NAMESPACES {
+		if errno := Setns(nsfds[i], ns.flag); errno != 0 {
+			log.Fatal("Error joining the ", ns.name, " namespace: ", errno)
+		}
+		Close(nsfds[i])
+	}
+	// Joining the mount namespace moved us in the container root
+	execProcess(process, -1, -1, ttyfd, interactive)
+	return 0, -1, 0
+}
+
+// execInContainer runs an additional process inside a running container
+func execInContainer(id string, args []string) {
+	state := loadContainerState(id)
+	slog.Debug("exec", "id", state.Id, "status", state.Status, "pid", state.Pid, "args", args)
+	if state.Status != StatusRunning {
+		log.Fatalf("Container %v is not running", state.Id)
+	}
+	// The process inherits the container settings, overridden by the command line
+	process := *state
+	process.Command = args
+	process.Env = ResolveEnv(state.Env, envVariables)
+	if len(workdir) != 0 {
+		process.Cwd = workdir
+	}
+	if len(user) != 0 {
+		process.User = user
+	}
+
+	pidns, nsfds, err := openNamespaces(state.Pid)
+	if err != nil {
+		log.Fatal("Error opening the namespaces of the container ", state.Id, ": ", err)
+	}
+	// setns on the pid namespace only affects the children of the calling thread,
+	// which must then be the one forking.
+	runtime.LockOSThread()
+	if errno := Setns(pidns, CLONE_NEWPID); errno != 0 {
+		log.Fatal("Error joining the pid namespace of the container ", state.Id, ": ", errno)
+	}
+	syscall.Close(pidns)
+
+	var term *Terminal
+	ttySlave := ""
+	if tty {
+		term, err = NewTerminal()
+		if err != nil {
+			log.Fatal("Error allocating a terminal: ", err)
+		}
+		ttySlave = term.Slave
+	}
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals, RUN_FORWARDED_SIGNALS...)
+	pid, pidfd, errno := execFork(state, &process, nsfds, ttySlave, interactive)
+	if errno != 0 {
+		log.Fatal("Error forking: ", errno)
+	}
+	for _, fd := range nsfds {
+		syscall.Close(fd)
+	}
+	if term != nil {
+		term.Proxy(interactive)
+	}
+	stopForwarding := forwardSignals(signals, pid, pidfd, time.Duration(stopTimeout)*time.Second)
+	ws, errno := Wait(pid)
+	if errno != 0 {
+		log.Fatalf("Error waiting for %v: %v", pid, errno)
+	}
+	stopForwarding()
+	if pidfd >= 0 {
+		Close(pidfd)
+	}
+	if term != nil {
+		term.Close()
+	}
+	slog.Debug("exec", "pid", pid, "status", ws)
+	os.Exit(ws.ExitStatus())
+}
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec <id> -- <command>",
+	Short: "Runs a process inside a running container",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		execInContainer(args[0], args[1:])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+	execCmd.Flags().StringArrayVarP(&envVariables, "env", "e", nil, "Sets environment variables. It can be repeated")
+	execCmd.Flags().StringVarP(&workdir, "workdir", "w", "", "Overrides the container working directory")
+	execCmd.Flags().StringVarP(&user, "user", "u", "", "Overrides the container user (name, uid, name:group or uid:gid)")
+	execCmd.Flags().BoolVarP(&tty, "tty", "t", false, "Allocate a pseudo-terminal for the process")
+	execCmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "Keep the standard input open")
+	execCmd.Flags().IntVar(&stopTimeout, "stop-timeout", 10, "Seconds to wait for the process to stop after SIGINT or SIGTERM before killing it (-1 to wait forever)")
+}
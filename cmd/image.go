@@ -0,0 +1,475 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"rocked/specs"
+	"rocked/specs/layout"
+	"rocked/utils"
+	"slices"
+	"time"
+
+	"log/slog"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// The manifest of the archives created by docker save
+	DOCKER_MANIFEST_FILE = "manifest.json"
+	imageInput           string
+	imageOutput          string
+)
+
+// An image of a docker save archive manifest.json
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// Returns the name of an image in the store: its ref name or, without one,
+// its digest.
+func imageName(desc specs.Descriptor) string {
+	if ref := desc.Annotations[specs.AnnotationRefName]; len(ref) != 0 {
+		return ref
+	}
+	return desc.Digest.String()
+}
+
+// Returns the media type of a docker save layer, which may be compressed
+func dockerLayerMediaType(f io.ReadSeeker) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return specs.MediaTypeImageLayerGzip, nil
+	}
+	return specs.MediaTypeImageLayer, nil
+}
+
+// Opens the regular file name of the archive extracted in dir.
+// The names leading out of dir, through ".." or a symbolic link, are
+// rejected: the archive is not trusted.
+func openArchiveFile(dir, name string) (*os.File, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("the archive file %q is outside the archive", name)
+	}
+	root, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(root)
+	how := unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	fd, err := unix.Openat2(root, name, &how)
+	if err != nil {
+		return nil, fmt.Errorf("opening the archive file %q: %w", name, err)
+	}
+	f := os.NewFile(uintptr(fd), filepath.Join(dir, name))
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("the archive file %q is not a regular file", name)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stores the file name of the archive extracted in dir as a blob.
+// If mediaType is empty, the one of a docker layer is detected.
+func addArchiveBlob(store *ImageStore, dir, name, mediaType string) (specs.Descriptor, error) {
+	f, err := openArchiveFile(dir, name)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer f.Close()
+	if len(mediaType) == 0 {
+		if mediaType, err = dockerLayerMediaType(f); err != nil {
+			return specs.Descriptor{}, err
+		}
+	}
+	return store.addBlob(f, mediaType)
+}
+
+// Imports the images of the docker save archive extracted in dir.
+// Every image is converted into an OCI manifest, with the docker config and
+// layers as blobs, and tagged with its repository tags.
+func importDockerArchive(store *ImageStore, dir string) ([]string, error) {
+	unlock, err := store.lockBlobs()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	f, err := openArchiveFile(dir, DOCKER_MANIFEST_FILE)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var images []dockerArchiveManifest
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("invalid %v: %w", DOCKER_MANIFEST_FILE, err)
+	}
+	var names []string
+	for _, image := range images {
+		slog.Debug("importDockerArchive", "config", image.Config, "tags", image.RepoTags)
+		manifest := specs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: specs.MediaTypeImageManifest,
+		}
+		manifest.Config, err = addArchiveBlob(store, dir, image.Config, specs.MediaTypeImageConfig)
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range image.Layers {
+			desc, err := addArchiveBlob(store, dir, layer, "")
+			if err != nil {
+				return nil, err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		desc, err := store.writeJSONBlob(specs.MediaTypeImageManifest, manifest)
+		if err != nil {
+			return nil, err
+		}
+		if len(image.RepoTags) == 0 {
+			if err := store.Tag(desc, ""); err != nil {
+				return nil, err
+			}
+			names = append(names, desc.Digest.String())
+		}
+		for _, tag := range image.RepoTags {
+			if err := store.Tag(desc, tag); err != nil {
+				return nil, err
+			}
+			names = append(names, tag)
+		}
+	}
+	return names, nil
+}
+
+// LoadImageArchive imports into the store the images of the archive read from
+// r, either an OCI image layout or a docker save archive.
+// It returns the names of the loaded images.
+func LoadImageArchive(store *ImageStore, r io.Reader) ([]string, error) {
+	tmp, err := os.MkdirTemp("", "rocked-load-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := utils.ExtractTar(r, tmp); err != nil {
+		return nil, err
+	}
+	if utils.PathExists(filepath.Join(tmp, specs.ImageLayoutFile)) {
+		if err := layout.Check(tmp); err != nil {
+			return nil, err
+		}
+		imported, err := store.ImportLayout(tmp, "")
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, desc := range imported {
+			names = append(names, imageName(desc))
+		}
+		return names, nil
+	}
+	if utils.PathExists(filepath.Join(tmp, DOCKER_MANIFEST_FILE)) {
+		return importDockerArchive(store, tmp)
+	}
+	return nil, errors.New("the archive is neither an OCI image layout nor a docker archive")
+}
+
+// SaveImages writes the images named refs to w, as an OCI image layout tar.
+// For an image index, all the manifests of the store it references are saved.
+func SaveImages(store *ImageStore, refs []string, w io.Writer) error {
+	index := layout.NewIndex()
+	var blobs []digest.Digest
+	seen := map[digest.Digest]bool{}
+	addBlob := func(d digest.Digest) {
+		if !seen[d] {
+			seen[d] = true
+			blobs = append(blobs, d)
+		}
+	}
+	for _, ref := range refs {
+		desc, err := store.Lookup(ref)
+		if err != nil {
+			return err
+		}
+		if specs.IsImageManifest(desc.MediaType) {
+			// Make sure the image is complete
+			if _, err := store.ReadManifest(desc); err != nil {
+				return err
+			}
+		}
+		reachable, _, err := store.reachable(specs.Index{Manifests: []specs.Descriptor{desc}})
+		if err != nil {
+			return err
+		}
+		addBlob(desc.Digest)
+		var others []digest.Digest
+		for d := range reachable {
+			if d != desc.Digest && store.HasBlob(d) {
+				others = append(others, d)
+			}
+		}
+		slices.Sort(others)
+		for _, d := range others {
+			addBlob(d)
+		}
+		// Saved under the name it has in the store
+		name := desc.Annotations[specs.AnnotationRefName]
+		desc.Annotations = nil
+		layout.AddManifest(&index, desc, name)
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	writeFile := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	data, err := layout.Marshal(specs.ImageLayout{Version: specs.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(specs.ImageLayoutFile, data); err != nil {
+		return err
+	}
+	data, err = layout.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(specs.ImageIndexFile, data); err != nil {
+		return err
+	}
+	dirs := map[string]bool{}
+	for _, d := range blobs {
+		name := layout.BlobName(d)
+		for _, dir := range []string{specs.ImageBlobsDir + "/", path.Dir(name) + "/"} {
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+			if err := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, ModTime: now, Typeflag: tar.TypeDir}); err != nil {
+				return err
+			}
+		}
+		info, err := os.Stat(store.BlobPath(d))
+		if err != nil {
+			return err
+		}
+		// The blobs are verified as they're copied, not to save a corrupted image
+		f, err := store.OpenBlob(specs.Descriptor{Digest: d, Size: info.Size()})
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: now, Typeflag: tar.TypeReg}
+		if err = tw.WriteHeader(hdr); err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Opens the image store, creating it if needed
+func openImageStore() *ImageStore {
+	store := NewImageStore(IMAGE_STORE_PATH)
+	if err := store.Init(); err != nil {
+		log.Fatal("Error opening the image store ", IMAGE_STORE_PATH, ": ", err)
+	}
+	return store
+}
+
+func loadImage(input string) {
+	var r io.Reader = os.Stdin
+	if len(input) != 0 {
+		f, err := os.Open(input)
+		if err != nil {
+			log.Fatal("Error opening ", input, ": ", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	names, err := LoadImageArchive(openImageStore(), bufio.NewReader(r))
+	if err != nil {
+		log.Fatal("Error loading the images: ", err)
+	}
+	for _, name := range names {
+		fmt.Println("Loaded image:", name)
+	}
+}
+
+func saveImages(refs []string, output string) {
+	store := openImageStore()
+	w := os.Stdout
+	if len(output) != 0 {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatal("Error creating ", output, ": ", err)
+		}
+		w = f
+	} else if IsTerminal(int(os.Stdout.Fd())) {
+		log.Fatal("Refusing to write the archive to a terminal, use -o or redirect the output")
+	}
+	bw := bufio.NewWriter(w)
+	err := SaveImages(store, refs, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if errc := w.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		if len(output) != 0 {
+			os.Remove(output)
+		}
+		log.Fatal("Error saving the images: ", err)
+	}
+}
+
+// ImageInspect is the description of an image printed by image inspect
+type ImageInspect struct {
+	Name string `json:"name,omitempty"`
+	// The digest of the image, an image index for multi-platform images
+	Digest         digest.Digest  `json:"digest"`
+	MediaType      string         `json:"mediaType"`
+	ManifestDigest digest.Digest  `json:"manifestDigest"`
+	Platform       string         `json:"platform"`
+	Manifest       specs.Manifest `json:"manifest"`
+	Config         specs.Image    `json:"config"`
+}
+
+// InspectImage describes the image ref for the platform want
+func InspectImage(store *ImageStore, ref string, want specs.Platform) (*ImageInspect, error) {
+	desc, err := store.Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc, err := store.ResolveManifest(desc, want)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := store.ReadManifest(manifestDesc)
+	if err != nil {
+		return nil, err
+	}
+	config, err := store.ReadConfig(manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	p := config.Platform
+	if manifestDesc.Platform != nil {
+		p = *manifestDesc.Platform
+	}
+	return &ImageInspect{
+		Name:           desc.Annotations[specs.AnnotationRefName],
+		Digest:         desc.Digest,
+		MediaType:      desc.MediaType,
+		ManifestDigest: manifestDesc.Digest,
+		Platform:       PlatformString(p),
+		Manifest:       manifest,
+		Config:         config,
+	}, nil
+}
+
+func inspectImages(refs []string, platform string) {
+	want, err := selectedPlatform(platform)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := openImageStore()
+	var inspected []*ImageInspect
+	for _, ref := range refs {
+		image, err := InspectImage(store, ref, want)
+		if err != nil {
+			log.Fatal("Error inspecting the image ", ref, ": ", err)
+		}
+		inspected = append(inspected, image)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(inspected); err != nil {
+		log.Fatal("Error encoding the images: ", err)
+	}
+}
+
+// imageCmd groups the commands managing images
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Manages images",
+}
+
+// imageLoadCmd represents the image load command
+var imageLoadCmd = &cobra.Command{
+	Use:   "load",
+	Short: "Loads images from an OCI image layout or docker save archive",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		loadImage(imageInput)
+	},
+}
+
+// imageSaveCmd represents the image save command
+var imageSaveCmd = &cobra.Command{
+	Use:   "save <image>...",
+	Short: "Saves images to an OCI image layout archive",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		saveImages(args, imageOutput)
+	},
+}
+
+// imageInspectCmd represents the image inspect command
+var imageInspectCmd = &cobra.Command{
+	Use:   "inspect <image>...",
+	Short: "Prints the manifest and config of images",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		inspectImages(args, platform)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageInspectCmd)
+	imageInspectCmd.Flags().StringVar(&platform, "platform", "", "Inspect the image for this platform (os/arch[/variant]) instead of the host one")
+	imageCmd.AddCommand(imageLoadCmd)
+	imageCmd.AddCommand(imageSaveCmd)
+	imageLoadCmd.Flags().StringVarP(&imageInput, "input", "i", "", "Read the archive from a file instead of the standard input")
+	imageSaveCmd.Flags().StringVarP(&imageOutput, "output", "o", "", "Write the archive to a file instead of the standard output")
+}
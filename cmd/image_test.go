@@ -0,0 +1,180 @@
+package cmd_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"rocked/cmd"
+	"rocked/specs"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Returns a tar archive of the content of dir
+func tarDir(t *testing.T, dir string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name, _ = filepath.Rel(dir, path)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			tw.Write(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestLoadSaveOCILayout(t *testing.T) {
+	store := newTestStore(t)
+	layout := makeLayout(t, "fedora:40", makeTar(t, map[string]string{"etc/os-release": "fedora"}))
+	names, err := cmd.LoadImageArchive(store, bytes.NewReader(tarDir(t, layout)))
+	if err != nil {
+		t.Fatalf("LoadImageArchive returned an error (%v)", err)
+	}
+	if !reflect.DeepEqual(names, []string{"fedora:40"}) {
+		t.Fatalf("LoadImageArchive loaded %v", names)
+	}
+	original, _ := store.Lookup("fedora:40")
+
+	var archive bytes.Buffer
+	if err := cmd.SaveImages(store, []string{"fedora:40"}, &archive); err != nil {
+		t.Fatalf("SaveImages returned an error (%v)", err)
+	}
+	other := newTestStore(t)
+	names, err = cmd.LoadImageArchive(other, &archive)
+	if err != nil {
+		t.Fatalf("LoadImageArchive of the saved archive returned an error (%v)", err)
+	}
+	if !reflect.DeepEqual(names, []string{"fedora:40"}) {
+		t.Fatalf("LoadImageArchive of the saved archive loaded %v", names)
+	}
+	loaded, _ := other.Lookup("fedora:40")
+	if loaded.Digest != original.Digest {
+		t.Fatalf("the saved image is %v, want %v", loaded.Digest, original.Digest)
+	}
+}
+
+func TestLoadOCILayoutBadVersion(t *testing.T) {
+	store := newTestStore(t)
+	layout := makeLayout(t, "bad", makeTar(t, map[string]string{"a": "a"}))
+	os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"2.0.0"}`), 0644)
+	if _, err := cmd.LoadImageArchive(store, bytes.NewReader(tarDir(t, layout))); err == nil {
+		t.Fatalf("LoadImageArchive accepted an unsupported layout version")
+	}
+}
+
+func TestLoadDockerArchive(t *testing.T) {
+	dir := t.TempDir()
+	layer := makeTar(t, map[string]string{"bin/sh": "shell"})
+	os.MkdirAll(filepath.Join(dir, "abc"), 0755)
+	os.WriteFile(filepath.Join(dir, "abc/layer.tar"), layer, 0644)
+	config, _ := json.Marshal(specs.Image{
+		Platform: specs.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   specs.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}},
+	})
+	configName := digest.FromBytes(config).Encoded() + ".json"
+	os.WriteFile(filepath.Join(dir, configName), config, 0644)
+	manifest, _ := json.Marshal([]map[string]any{{
+		"Config":   configName,
+		"RepoTags": []string{"busybox:latest"},
+		"Layers":   []string{"abc/layer.tar"},
+	}})
+	os.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0644)
+
+	store := newTestStore(t)
+	names, err := cmd.LoadImageArchive(store, bytes.NewReader(tarDir(t, dir)))
+	if err != nil {
+		t.Fatalf("LoadImageArchive returned an error (%v)", err)
+	}
+	if !reflect.DeepEqual(names, []string{"busybox:latest"}) {
+		t.Fatalf("LoadImageArchive loaded %v", names)
+	}
+	desc, err := store.Lookup("busybox:latest")
+	if err != nil {
+		t.Fatalf("Lookup returned an error (%v)", err)
+	}
+	m, err := store.ReadManifest(desc)
+	if err != nil {
+		t.Fatalf("ReadManifest returned an error (%v)", err)
+	}
+	if m.Config.Digest != digest.FromBytes(config) || len(m.Layers) != 1 || m.Layers[0].Digest != digest.FromBytes(layer) {
+		t.Fatalf("unexpected converted manifest %+v", m)
+	}
+	if m.Layers[0].MediaType != specs.MediaTypeImageLayer {
+		t.Fatalf("the layer media type is %v, want %v", m.Layers[0].MediaType, specs.MediaTypeImageLayer)
+	}
+}
+
+func TestLoadDockerArchiveOutside(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		layer string
+		// An extra symbolic link of the archive
+		link, target string
+	}{
+		{"dotdot", "../../../../../../../../.." + secret, "", ""},
+		{"absolute", secret, "", ""},
+		{"symlink", "layer.tar", "layer.tar", secret},
+		{"relative symlink", "layer.tar", "layer.tar", "../../../../../../../../.." + secret},
+		{"symlink parent", "dir/secret", "dir", filepath.Dir(secret)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			manifest, _ := json.Marshal([]map[string]any{{
+				"Config":   "config.json",
+				"RepoTags": []string{"evil:latest"},
+				"Layers":   []string{tt.layer},
+			}})
+			files := map[string][]byte{"manifest.json": manifest, "config.json": []byte(`{}`)}
+			for _, name := range []string{"manifest.json", "config.json"} {
+				tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))})
+				tw.Write(files[name])
+			}
+			if len(tt.link) != 0 {
+				tw.WriteHeader(&tar.Header{Name: tt.link, Typeflag: tar.TypeSymlink, Linkname: tt.target})
+			}
+			tw.Close()
+
+			store := newTestStore(t)
+			if _, err := cmd.LoadImageArchive(store, &buf); err == nil {
+				t.Fatalf("LoadImageArchive loaded a layer outside the archive")
+			}
+			if store.HasBlob(digest.FromString("secret")) {
+				t.Fatalf("the file outside the archive is in the store")
+			}
+		})
+	}
+}
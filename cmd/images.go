@@ -0,0 +1,220 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+var (
+	imagesFormat string
+	rmiForce     bool
+	pruneAll     bool
+)
+
+// Formats a size in bytes with the largest fitting unit
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
+
+func printImagesTable(w io.Writer, images []ImageSummary) {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tTAG\tDIGEST\tCREATED\tSIZE")
+	for _, image := range images {
+		created := "N/A"
+		if image.Created != nil {
+			created = humanDuration(time.Since(*image.Created)) + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", image.Repository, image.Tag, shortId(image.Digest.Encoded()), created, humanSize(image.Size))
+	}
+	tw.Flush()
+}
+
+func images() {
+	list, err := openImageStore().Images()
+	if err != nil {
+		log.Fatal("Error listing the images: ", err)
+	}
+	switch imagesFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(list); err != nil {
+			log.Fatal("Error encoding the images: ", err)
+		}
+	case "table":
+		printImagesTable(os.Stdout, list)
+	default:
+		log.Fatalf("Unknown format %q (valid formats are table and json)", imagesFormat)
+	}
+}
+
+// Returns the containers, which keep using their image layers until removed
+func containerStates() []*State {
+	states, err := ListStates(base_path)
+	if err != nil {
+		log.Fatal("Error listing the containers: ", err)
+	}
+	return states
+}
+
+// Returns the layer directories used by the containers
+func containerLayers(states []*State) []string {
+	var layers []string
+	for _, state := range states {
+		layers = append(layers, state.Layers...)
+	}
+	return layers
+}
+
+// Removes the blobs and layers not used anymore.
+// The containers are listed again once the store is locked, to keep the
+// layers of the ones created meanwhile.
+func collectImages(store *ImageStore) {
+	removed, freed, err := store.GarbageCollect(func() ([]string, error) {
+		states, err := ListStates(base_path)
+		if err != nil {
+			return nil, err
+		}
+		return containerLayers(states), nil
+	})
+	if err != nil {
+		log.Printf("Error removing the unused blobs: %v", err)
+	}
+	fmt.Printf("Removed %d blobs and layers, freed %s\n", removed, humanSize(freed))
+}
+
+// Removes the images named refs.
+// An image used by a container is only removed with force.
+func rmi(refs []string, force bool) {
+	store := openImageStore()
+	states := containerStates()
+	failed := false
+	for _, ref := range refs {
+		desc, err := store.Lookup(ref)
+		if err != nil {
+			log.Printf("Error removing the image %v: %v", ref, err)
+			failed = true
+			continue
+		}
+		used := false
+		for _, state := range states {
+			if state.ImageDigest == desc.Digest {
+				used = true
+				break
+			}
+		}
+		if used && !force {
+			log.Printf("Image %v is used by a container, remove it first or use --force", ref)
+			failed = true
+			continue
+		}
+		if err := store.Untag(ref); err != nil {
+			log.Printf("Error removing the image %v: %v", ref, err)
+			failed = true
+			continue
+		}
+		fmt.Println("Untagged:", ref)
+	}
+	collectImages(store)
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Removes the images without a name or, with all, the ones not used by a container
+func pruneImages(all bool) {
+	store := openImageStore()
+	states := containerStates()
+	removed, err := store.RemoveUnnamed()
+	if err != nil {
+		log.Fatal("Error removing the unnamed images: ", err)
+	}
+	for _, desc := range removed {
+		fmt.Println("Deleted:", desc.Digest)
+	}
+	if all {
+		used := map[digest.Digest]bool{}
+		for _, state := range states {
+			used[state.ImageDigest] = true
+		}
+		list, err := store.Images()
+		if err != nil {
+			log.Fatal("Error listing the images: ", err)
+		}
+		for _, image := range list {
+			if used[image.Digest] || len(image.Name) == 0 {
+				continue
+			}
+			if err := store.Untag(image.Name); err != nil {
+				log.Printf("Error removing the image %v: %v", image.Name, err)
+				continue
+			}
+			fmt.Println("Untagged:", image.Name)
+		}
+	}
+	collectImages(store)
+}
+
+// imagesCmd represents the images command
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "Lists images",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		images()
+	},
+}
+
+// rmiCmd represents the rmi command
+var rmiCmd = &cobra.Command{
+	Use:   "rmi <image>...",
+	Short: "Removes images",
+	Long: `Removes images, by name or digest, and the blobs and layers no other image uses.
+An image used by a container is only removed with --force.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rmi(args, rmiForce)
+	},
+}
+
+// imagePruneCmd represents the image prune command
+var imagePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Removes unused images",
+	Long: `Removes the images without a name and the blobs and layers no image uses.
+With -a, all the images not used by a container are removed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pruneImages(pruneAll)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+	imagesCmd.Flags().StringVar(&imagesFormat, "format", "table", "Output format (table or json)")
+	rootCmd.AddCommand(rmiCmd)
+	rmiCmd.Flags().BoolVarP(&rmiForce, "force", "f", false, "Remove images used by containers")
+	imageCmd.AddCommand(imagePruneCmd)
+	imagePruneCmd.Flags().BoolVarP(&pruneAll, "all", "a", false, "Remove all the images not used by a container")
+}
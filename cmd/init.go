@@ -0,0 +1,115 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"debug/elf"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	useInit bool
+	// Signals relayed by the init to the container command
+	INIT_FORWARDED_SIGNALS = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+)
+
+// Reaps all the terminated children.
+// It returns the status of pid if it was among them.
+func reapChildren(pid int) (WaitStatus, bool) {
+	var status WaitStatus
+	found := false
+	for {
+		ws, err := Wait4(-1, syscall.WNOHANG)
+		if err != 0 || ws.Pid == 0 {
+			return status, found
+		}
+		slog.Debug("init reaped", "pid", ws.Pid, "status", ws)
+		if ws.Pid == pid {
+			status = ws
+			found = true
+		}
+	}
+}
+
+// CheckInitLoader checks that the rocked binary exe can run as the init of
+// the container whose root is root: when exe is dynamically linked (built
+// with cgo), its program interpreter, the dynamic loader, must be in the root,
+// which isn't the case for the images without glibc, such as alpine or
+// busybox.
+func CheckInitLoader(exe, root string) error {
+	f, err := elf.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return err
+		}
+		interp := string(data)
+		if i := strings.IndexByte(interp, 0); i >= 0 {
+			interp = interp[:i]
+		}
+		slog.Debug("CheckInitLoader", "exe", exe, "interpreter", interp)
+		if _, err := os.Stat(filepath.Join(root, interp)); err != nil {
+			return fmt.Errorf("the rocked binary is dynamically linked and the image has no %v to run it as init: build it statically (CGO_ENABLED=0) to use --init with this image", interp)
+		}
+	}
+	return nil
+}
+
+// containerInit runs as PID 1 of the container.
+// It starts the command, forwards the signals it gets to it, reaps the
+// orphaned processes and exits with the command exit status.
+func containerInit(args []string) {
+	slog.Debug("init", "pid", os.Getpid(), "args", args)
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals, append(INIT_FORWARDED_SIGNALS, syscall.SIGCHLD)...)
+	proc, err := os.StartProcess(args[0], args, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		log.Fatal("Error starting ", args[0], ": ", err)
+	}
+	for sig := range signals {
+		if sig != syscall.SIGCHLD {
+			slog.Debug("init forwarding", "signal", sig, "pid", proc.Pid)
+			Kill(proc.Pid, sig.(syscall.Signal))
+			continue
+		}
+		if ws, done := reapChildren(proc.Pid); done {
+			os.Exit(ws.ExitStatus())
+		}
+	}
+}
+
+// initCmd represents the internal init command, executed as PID 1 of the container with --init
+var initCmd = &cobra.Command{
+	Use:    "init -- <command>",
+	Short:  "Minimal init for containers",
+	Hidden: true,
+	Args:   cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		containerInit(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+}
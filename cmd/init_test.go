@@ -0,0 +1,35 @@
+package cmd_test
+
+import (
+	"debug/elf"
+	"os"
+	"rocked/cmd"
+	"testing"
+)
+
+func TestCheckInitLoader(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamic := false
+	for _, prog := range f.Progs {
+		dynamic = dynamic || prog.Type == elf.PT_INTERP
+	}
+	f.Close()
+	if err := cmd.CheckInitLoader(exe, "/"); err != nil {
+		t.Fatalf("CheckInitLoader on the host root returned an error (%v)", err)
+	}
+	// A root without glibc, as alpine or busybox
+	err = cmd.CheckInitLoader(exe, t.TempDir())
+	if dynamic && err == nil {
+		t.Fatalf("CheckInitLoader of a dynamic binary on an empty root returned no error")
+	}
+	if !dynamic && err != nil {
+		t.Fatalf("CheckInitLoader of a static binary returned an error (%v)", err)
+	}
+}
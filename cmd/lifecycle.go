@@ -0,0 +1,227 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	deleteForce bool
+	SIGNALS     = map[string]syscall.Signal{
+		"HUP":  syscall.SIGHUP,
+		"INT":  syscall.SIGINT,
+		"QUIT": syscall.SIGQUIT,
+		"KILL": syscall.SIGKILL,
+		"USR1": syscall.SIGUSR1,
+		"USR2": syscall.SIGUSR2,
+		"TERM": syscall.SIGTERM,
+		"CONT": syscall.SIGCONT,
+		"STOP": syscall.SIGSTOP,
+	}
+)
+
+// ParseSignal converts a signal name (TERM, SIGTERM) or number into a signal.
+func ParseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal %v", name)
+		}
+		return syscall.Signal(n), nil
+	}
+	sig, ok := SIGNALS[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %v", name)
+	}
+	return sig, nil
+}
+
+// Loads the state of the container with the given id (or id prefix)
+func loadContainerState(id string) *State {
+	cid, err := ResolveContainerId(base_path, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	state, err := LoadState(base_path + cid)
+	if err != nil {
+		log.Fatal("Error loading the state of the container ", cid, ": ", err)
+	}
+	state.Refresh()
+	return state
+}
+
+func create(args []string, entrypointSet bool) {
+	slog.Debug("create", "args", args)
+	con, _ := prepareContainer(args, entrypointSet)
+	id, err := startShim(con, true)
+	if err != nil {
+		log.Fatal("Error creating the container ", con.id, ": ", err)
+	}
+	fmt.Println(id)
+}
+
+// start releases a created container by opening its exec fifo.
+func start(id string) {
+	state := loadContainerState(id)
+	slog.Debug("start", "id", state.Id, "status", state.Status)
+	if state.Status != StatusCreated {
+		log.Fatalf("Container %v is %v, only created containers can be started", state.Id, state.Status)
+	}
+	fifo := state.Bundle + "/" + EXEC_FIFO
+	f, err := os.OpenFile(fifo, os.O_RDONLY, 0)
+	if err != nil {
+		log.Fatal("Error opening the exec fifo of the container ", state.Id, ": ", err)
+	}
+	defer os.Remove(fifo)
+	defer f.Close()
+	buf := make([]byte, 1)
+	if _, err := f.Read(buf); err != nil {
+		log.Fatal("Error starting the container ", state.Id, ": ", err)
+	}
+	if err := state.SetStarted(); err != nil {
+		log.Printf("Error saving the state of the container %v: %v", state.Id, err)
+	}
+}
+
+func printState(id string) {
+	state := loadContainerState(id)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(state); err != nil {
+		log.Fatal("Error encoding the state: ", err)
+	}
+}
+
+func kill(id, signal string) {
+	sig, err := ParseSignal(signal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	state := loadContainerState(id)
+	slog.Debug("kill", "id", state.Id, "status", state.Status, "pid", state.Pid, "signal", sig)
+	if state.Status != StatusCreated && state.Status != StatusRunning {
+		log.Fatalf("Container %v is not running", state.Id)
+	}
+	if errno := Kill(state.Pid, sig); errno != 0 {
+		log.Fatal("Error sending ", sig, " to the container ", state.Id, ": ", errno)
+	}
+}
+
+// Waits up to timeout for the container to be recorded as stopped by its shim
+func waitStopped(state *State, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		s, err := LoadState(state.Bundle)
+		if err != nil {
+			return false
+		}
+		s.Refresh()
+		if s.Status == StatusStopped {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// delete removes a stopped container: its mounts, its cgroup and its directory.
+// With force, a running container is killed first.
+func deleteContainer(id string, force bool) {
+	state := loadContainerState(id)
+	slog.Debug("delete", "id", state.Id, "status", state.Status, "force", force)
+	if state.Status != StatusStopped {
+		if !force {
+			log.Fatalf("Container %v is %v, stop it first or use --force", state.Id, state.Status)
+		}
+		if errno := Kill(state.Pid, syscall.SIGKILL); errno != 0 && errno != syscall.ESRCH {
+			log.Fatal("Error killing the container ", state.Id, ": ", errno)
+		}
+		if !waitStopped(state, 10*time.Second) {
+			log.Fatalf("Container %v did not stop", state.Id)
+		}
+	}
+	if err := CleanupContainer(state); err != nil {
+		log.Fatal("Error removing the container ", state.Id, ": ", err)
+	}
+}
+
+// createCmd represents the create command
+var createCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates a container without starting it",
+	Long: `Creates a container and its process, which waits to be started with the start command.
+It prints the id of the new container.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		create(args, cmd.Flags().Changed("entrypoint"))
+	},
+}
+
+// startCmd represents the start command
+var startCmd = &cobra.Command{
+	Use:   "start <id>",
+	Short: "Starts a created container",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		start(args[0])
+	},
+}
+
+// stateCmd represents the state command
+var stateCmd = &cobra.Command{
+	Use:   "state <id>",
+	Short: "Prints the state of a container",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		printState(args[0])
+	},
+}
+
+// killCmd represents the kill command
+var killCmd = &cobra.Command{
+	Use:   "kill <id> [signal]",
+	Short: "Sends a signal to a container (default TERM)",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		signal := "TERM"
+		if len(args) == 2 {
+			signal = args[1]
+		}
+		kill(args[0], signal)
+	},
+}
+
+// deleteCmd represents the delete command
+var deleteCmd = &cobra.Command{
+	Use:     "delete <id>...",
+	Short:   "Deletes stopped containers",
+	Aliases: []string{"rm"},
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, id := range args {
+			deleteContainer(id, deleteForce)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(createCmd)
+	addProcessFlags(createCmd)
+	createCmd.Flags().BoolVar(&autoRemove, "rm", false, "Remove the container once it stops")
+	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(stateCmd)
+	rootCmd.AddCommand(killCmd)
+	rootCmd.AddCommand(deleteCmd)
+	deleteCmd.Flags().BoolVarP(&deleteForce, "force", "f", false, "Kill the container if it is still running")
+}
@@ -0,0 +1,33 @@
+package cmd_test
+
+import (
+	"rocked/cmd"
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{"TERM", syscall.SIGTERM, false},
+		{"SIGKILL", syscall.SIGKILL, false},
+		{"hup", syscall.SIGHUP, false},
+		{"10", syscall.Signal(10), false},
+		{"0", 0, true},
+		{"FOO", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cmd.ParseSignal(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
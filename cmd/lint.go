@@ -0,0 +1,172 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"rocked/specs"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+// LintError lists the rules of the image spec broken by a document of the
+// store
+type LintError struct {
+	Desc       specs.Descriptor
+	Violations []specs.Violation
+}
+
+func (e *LintError) Error() string {
+	var msgs []string
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.String())
+	}
+	return fmt.Sprintf("%v %v: %v", e.Desc.MediaType, e.Desc.Digest, strings.Join(msgs, "; "))
+}
+
+// Reads the document desc and checks it against the image spec
+func (s *ImageStore) lintDocument(desc specs.Descriptor) ([]byte, error) {
+	r, err := s.OpenBlob(desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if violations := specs.ValidateBlob(desc, data); len(violations) != 0 {
+		return data, &LintError{Desc: desc, Violations: violations}
+	}
+	return data, nil
+}
+
+// Lint checks the documents of the images named refs or, without refs, of
+// all the images of the store against the rules of the image spec: the index
+// entries, image indexes, manifests and image configurations.
+// The manifests of an image index missing from the store (e.g. pulled for a
+// single platform) are skipped.
+// It returns the number of documents checked and an error for every document
+// missing or breaking rules, a LintError for the latter.
+func (s *ImageStore) Lint(refs []string) (int, []error) {
+	var roots []specs.Descriptor
+	var errs []error
+	if len(refs) == 0 {
+		index, err := s.ReadIndex()
+		if err != nil {
+			return 0, []error{err}
+		}
+		roots = index.Manifests
+	}
+	for _, ref := range refs {
+		desc, err := s.Lookup(ref)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		roots = append(roots, desc)
+	}
+	linted := map[digest.Digest]bool{}
+	lint := func(desc specs.Descriptor) []byte {
+		if linted[desc.Digest] {
+			return nil
+		}
+		linted[desc.Digest] = true
+		slog.Debug("ImageStore: Lint", "document", desc.Digest, "mediaType", desc.MediaType)
+		data, err := s.lintDocument(desc)
+		if err != nil {
+			if _, ok := err.(*LintError); !ok {
+				err = fmt.Errorf("%v %v: %w", desc.MediaType, desc.Digest, err)
+			}
+			errs = append(errs, err)
+		}
+		return data
+	}
+	var walk func(desc specs.Descriptor)
+	walk = func(desc specs.Descriptor) {
+		// The descriptor of the index entry only, the document is checked
+		// with it
+		if !specs.IsImageIndex(desc.MediaType) && !specs.IsImageManifest(desc.MediaType) {
+			if violations := specs.ValidateDescriptor(desc); len(violations) != 0 {
+				errs = append(errs, &LintError{Desc: desc, Violations: violations})
+			}
+			return
+		}
+		data := lint(desc)
+		if data == nil {
+			return
+		}
+		switch {
+		case specs.IsImageIndex(desc.MediaType):
+			var nested specs.Index
+			if json.Unmarshal(data, &nested) != nil {
+				return
+			}
+			for _, m := range nested.Manifests {
+				if !s.HasBlob(m.Digest) {
+					slog.Debug("ImageStore: Lint missing manifest", "manifest", m.Digest, "platform", m.Platform)
+					continue
+				}
+				walk(m)
+			}
+		case specs.IsImageManifest(desc.MediaType):
+			var manifest specs.Manifest
+			if json.Unmarshal(data, &manifest) != nil {
+				return
+			}
+			// The configs of the artifacts have no rules
+			if specs.IsImageConfig(manifest.Config.MediaType) {
+				lint(manifest.Config)
+			}
+		}
+	}
+	for _, desc := range roots {
+		walk(desc)
+	}
+	return len(linted), errs
+}
+
+func lintImages(refs []string) {
+	store := openImageStore()
+	linted, errs := store.Lint(refs)
+	broken := 0
+	for _, err := range errs {
+		lintErr, ok := err.(*LintError)
+		if !ok {
+			log.Print(err)
+			continue
+		}
+		broken++
+		for _, v := range lintErr.Violations {
+			fmt.Printf("%v (%v): %v\n", lintErr.Desc.Digest, lintErr.Desc.MediaType, v)
+		}
+	}
+	if len(errs) != 0 {
+		log.Fatalf("Linted %d documents: %d break the image spec, %d could not be checked", linted, broken, len(errs)-broken)
+	}
+	fmt.Printf("Linted %d documents\n", linted)
+}
+
+// imageLintCmd represents the image lint command
+var imageLintCmd = &cobra.Command{
+	Use:   "lint [image]...",
+	Short: "Checks the documents of images against the OCI image spec, all of them by default",
+	Long: `Checks the image indexes, manifests and configurations of images against the rules of the OCI image spec:
+the required fields, the schema version, the media types, digests and sizes of the descriptors matching
+the documents, and the format of the annotations.
+Every violation is printed with the JSON path of the value breaking the rule.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lintImages(args)
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imageLintCmd)
+}
@@ -0,0 +1,90 @@
+package cmd_test
+
+import (
+	"bytes"
+	"errors"
+	"rocked/cmd"
+	"rocked/specs"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageStoreLint(t *testing.T) {
+	store := newTestStore(t)
+	layer := makeTar(t, map[string]string{"etc/os-release": "fedora"})
+	if _, err := store.ImportLayout(makeLayout(t, "fedora", layer), ""); err != nil {
+		t.Fatalf("ImportLayout returned an error (%v)", err)
+	}
+	linted, errs := store.Lint(nil)
+	if len(errs) != 0 {
+		t.Fatalf("Lint returned errors (%v)", errs)
+	}
+	// The manifest and the config
+	if linted != 2 {
+		t.Fatalf("Lint checked %v documents, want 2", linted)
+	}
+
+	// A manifest and a config breaking the spec
+	writeBlob := func(data string) specs.Descriptor {
+		d := digest.FromString(data)
+		if err := store.WriteBlob(bytes.NewReader([]byte(data)), d); err != nil {
+			t.Fatalf("WriteBlob returned an error (%v)", err)
+		}
+		return specs.Descriptor{Digest: d, Size: int64(len(data))}
+	}
+	config := writeBlob(`{"architecture":"amd64","rootfs":{"type":"layers","diff_ids":[]}}`)
+	manifest := writeBlob(`{"schemaVersion":1,"config":{"mediaType":"` + specs.MediaTypeImageConfig + `","digest":"` + config.Digest.String() + `","size":1},"layers":[]}`)
+	manifest.MediaType = specs.MediaTypeImageManifest
+	if err := store.Tag(manifest, "broken"); err != nil {
+		t.Fatalf("Tag returned an error (%v)", err)
+	}
+	linted, errs = store.Lint([]string{"broken"})
+	if linted != 2 {
+		t.Fatalf("Lint checked %v documents, want 2", linted)
+	}
+	var paths []string
+	for _, err := range errs {
+		var lintErr *cmd.LintError
+		if errors.As(err, &lintErr) {
+			if lintErr.Desc.Digest != manifest.Digest {
+				t.Fatalf("a LintError is for %v, want %v", lintErr.Desc.Digest, manifest.Digest)
+			}
+			for _, v := range lintErr.Violations {
+				paths = append(paths, v.Path)
+			}
+			continue
+		}
+		// The config size is wrong, it can't be read
+		var verr *cmd.BlobVerificationError
+		if !errors.As(err, &verr) || verr.Digest != config.Digest {
+			t.Fatalf("Lint returned %v, want a BlobVerificationError for the config", err)
+		}
+	}
+	if len(errs) != 2 || !slices.Equal(paths, []string{"$.schemaVersion", "$.layers"}) {
+		t.Fatalf("Lint returned %v", errs)
+	}
+
+	// The size fixed, the config is checked
+	manifest = writeBlob(`{"schemaVersion":2,"config":{"mediaType":"` + specs.MediaTypeImageConfig + `","digest":"` + config.Digest.String() + `","size":` + strconv.FormatInt(config.Size, 10) + `},"layers":[]}`)
+	manifest.MediaType = specs.MediaTypeImageManifest
+	if err := store.Tag(manifest, "broken"); err != nil {
+		t.Fatalf("Tag returned an error (%v)", err)
+	}
+	_, errs = store.Lint([]string{"broken"})
+	paths = nil
+	for _, err := range errs {
+		var lintErr *cmd.LintError
+		if !errors.As(err, &lintErr) {
+			t.Fatalf("Lint returned %v, want LintErrors", err)
+		}
+		for _, v := range lintErr.Violations {
+			paths = append(paths, v.Path)
+		}
+	}
+	if !slices.Equal(paths, []string{"$.layers", "$.os"}) {
+		t.Fatalf("Lint found the violations of %v", paths)
+	}
+}
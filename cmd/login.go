@@ -0,0 +1,200 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"rocked/registry"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	authFile      string
+	username      string
+	password      string
+	passwordStdin bool
+)
+
+// Returns the path of the credentials file, --authfile if given
+func authFilePath() (string, error) {
+	if len(authFile) != 0 {
+		return authFile, nil
+	}
+	return registry.DefaultAuthFile()
+}
+
+// Reads the credentials file used by the commands
+func openAuthFile() (*registry.AuthFile, error) {
+	path, err := authFilePath()
+	if err != nil {
+		return nil, err
+	}
+	return registry.LoadAuthFile(path)
+}
+
+// Reads a line from r, without the line ending
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Asks the missing credentials for host on the terminal, the password
+// without echoing it
+func promptCredentials(host, user, pass string) (string, string, error) {
+	stdin := bufio.NewReader(os.Stdin)
+	var err error
+	if len(user) == 0 {
+		fmt.Fprintf(os.Stderr, "Username for %v: ", host)
+		if user, err = readLine(stdin); err != nil {
+			return "", "", err
+		}
+	}
+	if len(pass) == 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+		fd := int(os.Stdin.Fd())
+		if IsTerminal(fd) {
+			old, err := SetNoEchoTerminal(fd)
+			if err != nil {
+				return "", "", err
+			}
+			pass, err = readLine(stdin)
+			RestoreTerminal(fd, old)
+			fmt.Fprintln(os.Stderr)
+		} else {
+			pass, err = readLine(stdin)
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return user, pass, nil
+}
+
+// Login checks the credentials on the registry host and stores them in the
+// credentials file.
+func Login(ctx context.Context, client *registry.Client, file *registry.AuthFile, host, user, pass string) error {
+	slog.Debug("Login", "host", host, "username", user, "authfile", file.Path)
+	if len(user) == 0 || len(pass) == 0 {
+		return errors.New("a username and a password are needed")
+	}
+	if err := client.Login(ctx, host, user, pass); err != nil {
+		return err
+	}
+	if err := file.Set(host, user, pass); err != nil {
+		return err
+	}
+	return file.Save()
+}
+
+// Logout removes the credentials of the registry host from the credentials
+// file.
+func Logout(file *registry.AuthFile, host string) error {
+	slog.Debug("Logout", "host", host, "authfile", file.Path)
+	if err := file.Remove(host); err != nil {
+		return err
+	}
+	return file.Save()
+}
+
+func login(host string) {
+	if len(host) == 0 {
+		host = registry.DEFAULT_REGISTRY
+	}
+	if passwordStdin {
+		if len(password) != 0 {
+			log.Fatal("--password and --password-stdin are mutually exclusive")
+		}
+		if len(username) == 0 {
+			log.Fatal("--password-stdin needs --username")
+		}
+		var err error
+		if password, err = readLine(bufio.NewReader(os.Stdin)); err != nil {
+			log.Fatal("Error reading the password: ", err)
+		}
+	}
+	user, pass, err := promptCredentials(host, username, password)
+	if err != nil {
+		log.Fatal("Error reading the credentials: ", err)
+	}
+	file, err := openAuthFile()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := Login(context.Background(), newRegistryClient(), file, host, user, pass); err != nil {
+		log.Fatal("Error logging in to ", host, ": ", err)
+	}
+	fmt.Println("Login Succeeded!")
+}
+
+func logout(host string) {
+	if len(host) == 0 {
+		host = registry.DEFAULT_REGISTRY
+	}
+	file, err := openAuthFile()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := Logout(file, host); err != nil {
+		log.Fatal("Error logging out of ", host, ": ", err)
+	}
+	fmt.Println("Removed login credentials for", host)
+}
+
+// loginCmd represents the login command
+var loginCmd = &cobra.Command{
+	Use:   "login [registry]",
+	Short: "Logs in to a registry",
+	Long: `Logs in to a registry, docker.io if none is given.
+The credentials are checked on the registry and stored in the credentials file, $REGISTRY_AUTH_FILE
+or ~/.config/rocked/auth.json by default, used by pull and push.
+The file has the format of docker's config.json: the credentials of the registries in "credHelpers",
+or of all of them with "credsStore", are kept by the docker-credential-<helper> executable.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		host := ""
+		if len(args) == 1 {
+			host = args[0]
+		}
+		login(host)
+	},
+}
+
+// logoutCmd represents the logout command
+var logoutCmd = &cobra.Command{
+	Use:   "logout [registry]",
+	Short: "Logs out of a registry",
+	Long:  `Removes the credentials of a registry, docker.io if none is given, from the credentials file.`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		host := ""
+		if len(args) == 1 {
+			host = args[0]
+		}
+		logout(host)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(logoutCmd)
+	loginCmd.Flags().StringVarP(&username, "username", "u", "", "The username, asked if not given")
+	loginCmd.Flags().StringVarP(&password, "password", "p", "", "The password, asked if not given")
+	loginCmd.Flags().BoolVar(&passwordStdin, "password-stdin", false, "Read the password from the standard input")
+	loginCmd.Flags().BoolVar(&plainHTTP, "plain-http", false, "Use http instead of https to talk to the registry")
+	for _, cmd := range []*cobra.Command{loginCmd, logoutCmd, pullCmd, pushCmd} {
+		cmd.Flags().StringVar(&authFile, "authfile", "", "The credentials file (default $REGISTRY_AUTH_FILE or ~/.config/rocked/auth.json)")
+	}
+}
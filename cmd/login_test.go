@@ -0,0 +1,49 @@
+package cmd_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"rocked/cmd"
+	"rocked/registry"
+	"rocked/registry/registrytest"
+	"testing"
+)
+
+func TestLogin(t *testing.T) {
+	reg := registrytest.New()
+	reg.Username, reg.Password = "user", "secret"
+	host, client := serveLayout(t, reg, "private", makeLayout(t, "v1", makeTar(t, map[string]string{"a": "a"})))
+	file, err := registry.LoadAuthFile(filepath.Join(t.TempDir(), "auth.json"))
+	if err != nil {
+		t.Fatalf("LoadAuthFile returned an error (%v)", err)
+	}
+
+	if err := cmd.Login(context.Background(), client, file, host, "user", "wrong"); err == nil {
+		t.Fatalf("Login succeeded with a wrong password")
+	}
+	if err := cmd.Login(context.Background(), client, file, host, "user", "secret"); err != nil {
+		t.Fatalf("Login returned an error (%v)", err)
+	}
+
+	// The pulls use the stored credentials
+	file, err = registry.LoadAuthFile(file.Path)
+	if err != nil {
+		t.Fatalf("LoadAuthFile returned an error (%v)", err)
+	}
+	client.Credentials = file.Get
+	ref, _ := cmd.ParseReference(host + "/private:v1")
+	if _, err := cmd.PullImage(context.Background(), client, newTestStore(t), ref, cmd.HostPlatform()); err != nil {
+		t.Fatalf("PullImage returned an error (%v)", err)
+	}
+
+	if err := cmd.Logout(file, host); err != nil {
+		t.Fatalf("Logout returned an error (%v)", err)
+	}
+	if err := cmd.Logout(file, host); !errors.Is(err, registry.ErrNotLoggedIn) {
+		t.Fatalf("Logout of a registry without credentials returned %v", err)
+	}
+	if username, _, err := file.Get(host); err != nil || len(username) != 0 {
+		t.Fatalf("the credentials are still there: %v (%v)", username, err)
+	}
+}
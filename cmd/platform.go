@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"rocked/specs"
+)
+
+var (
+	platform string
+	// Other names used for the architectures
+	ARCH_ALIASES = map[string]string{
+		"x86_64":  "amd64",
+		"x86-64":  "amd64",
+		"aarch64": "arm64",
+		"armhf":   "arm",
+		"armel":   "arm",
+		"i386":    "386",
+	}
+	// The variant assumed for an architecture, when not given
+	DEFAULT_VARIANTS = map[string]string{
+		"arm64": "v8",
+		"arm":   "v7",
+	}
+)
+
+// NoMatchingPlatformError is returned when no manifest of an image index
+// runs on the wanted platform.
+type NoMatchingPlatformError struct {
+	Want      specs.Platform
+	Available []specs.Platform
+}
+
+func (e *NoMatchingPlatformError) Error() string {
+	var available []string
+	for _, p := range e.Available {
+		available = append(available, PlatformString(p))
+	}
+	if len(available) == 0 {
+		return fmt.Sprintf("no manifest for platform %v", PlatformString(e.Want))
+	}
+	return fmt.Sprintf("no manifest for platform %v (available: %v)", PlatformString(e.Want), strings.Join(available, ", "))
+}
+
+// Normalises the architecture and variant of a platform
+func normalizePlatform(p specs.Platform) specs.Platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Architecture = strings.ToLower(p.Architecture)
+	if arch, ok := ARCH_ALIASES[p.Architecture]; ok {
+		p.Architecture = arch
+	}
+	p.Variant = strings.ToLower(p.Variant)
+	if len(p.Variant) == 0 {
+		p.Variant = DEFAULT_VARIANTS[p.Architecture]
+	}
+	return p
+}
+
+// HostPlatform returns the platform rocked runs on
+func HostPlatform() specs.Platform {
+	return normalizePlatform(specs.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH})
+}
+
+// ParsePlatform parses a platform as os/arch[/variant], e.g. linux/arm64/v8
+func ParsePlatform(s string) (specs.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return specs.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	p := specs.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return normalizePlatform(p), nil
+}
+
+// Returns the platform selected with --platform, or the host one
+func selectedPlatform(s string) (specs.Platform, error) {
+	if len(s) == 0 {
+		return HostPlatform(), nil
+	}
+	return ParsePlatform(s)
+}
+
+// PlatformString formats a platform as os/arch[/variant]
+func PlatformString(p specs.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if len(p.Variant) != 0 {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// MatchPlatform tells how well a manifest for the platform have runs on the
+// platform want: 0 if it doesn't, higher is better.
+// The OS and the architecture must be the same and the features the manifest
+// requires must be in want. An exact variant is better than a lower one
+// (e.g. arm/v6 runs on arm/v7).
+func MatchPlatform(want, have specs.Platform) int {
+	want = normalizePlatform(want)
+	have = normalizePlatform(have)
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return 0
+	}
+	if len(want.OSVersion) != 0 && len(have.OSVersion) != 0 && want.OSVersion != have.OSVersion {
+		return 0
+	}
+	for _, feature := range have.OSFeatures {
+		if !slices.Contains(want.OSFeatures, feature) {
+			return 0
+		}
+	}
+	score := 1
+	switch {
+	case want.Variant == have.Variant:
+		score += 2
+	case len(have.Variant) == 0:
+		score += 1
+	case lowerVariant(have.Variant, want.Variant):
+		score += 1
+	default:
+		return 0
+	}
+	// Prefer the manifests without extra requirements, without making a
+	// match look like a mismatch
+	score = score*1000 - min(len(have.OSFeatures), 999)
+	return score
+}
+
+// Tells if the variant v (e.g. v6) is a lower version than of
+func lowerVariant(v, of string) bool {
+	n, ok := variantNumber(v)
+	if !ok {
+		return false
+	}
+	m, ok := variantNumber(of)
+	return ok && n < m
+}
+
+// Returns the number of a variant like v8
+func variantNumber(v string) (int, bool) {
+	digits, ok := strings.CutPrefix(v, "v")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	return n, err == nil
+}
@@ -0,0 +1,163 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"rocked/cmd"
+	"rocked/specs"
+	"strconv"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		platform string
+		want     specs.Platform
+		wantErr  bool
+	}{
+		{"linux/amd64", specs.Platform{OS: "linux", Architecture: "amd64"}, false},
+		{"linux/x86_64", specs.Platform{OS: "linux", Architecture: "amd64"}, false},
+		{"linux/arm64", specs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, false},
+		{"linux/aarch64/v8", specs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, false},
+		{"linux/arm/v6", specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{"linux", specs.Platform{}, true},
+		{"linux/", specs.Platform{}, true},
+		{"linux/arm/v7/extra", specs.Platform{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			got, err := cmd.ParsePlatform(tt.platform)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatform(%q) returned error %v, wantErr %v", tt.platform, err, tt.wantErr)
+			}
+			if err == nil && (got.OS != tt.want.OS || got.Architecture != tt.want.Architecture || got.Variant != tt.want.Variant) {
+				t.Fatalf("ParsePlatform(%q) = %+v, want %+v", tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	armv7 := specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	var manyFeatures []string
+	for i := 0; i < 12; i++ {
+		manyFeatures = append(manyFeatures, "feature"+strconv.Itoa(i))
+	}
+	tests := []struct {
+		name  string
+		want  specs.Platform
+		have  specs.Platform
+		match bool
+	}{
+		{"same", armv7, armv7, true},
+		{"lower variant", armv7, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, true},
+		{"higher variant", specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, armv7, false},
+		{"other arch", armv7, specs.Platform{OS: "linux", Architecture: "amd64"}, false},
+		{"other os", armv7, specs.Platform{OS: "windows", Architecture: "arm", Variant: "v7"}, false},
+		{"arm64 default variant", specs.Platform{OS: "linux", Architecture: "arm64"}, specs.Platform{OS: "linux", Architecture: "aarch64", Variant: "v8"}, true},
+		{"missing feature", armv7, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7", OSFeatures: []string{"sse4"}}, false},
+		{"two digits variant", specs.Platform{OS: "linux", Architecture: "arm", Variant: "v10"}, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v8"}, true},
+		{"higher two digits variant", specs.Platform{OS: "linux", Architecture: "arm", Variant: "v8"}, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v10"}, false},
+		{"many features", specs.Platform{OS: "linux", Architecture: "amd64", OSFeatures: manyFeatures}, specs.Platform{OS: "linux", Architecture: "amd64", OSFeatures: manyFeatures}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cmd.MatchPlatform(tt.want, tt.have) > 0; got != tt.match {
+				t.Fatalf("MatchPlatform(%+v, %+v) matches %v, want %v", tt.want, tt.have, got, tt.match)
+			}
+		})
+	}
+	// The exact variant is better than a compatible one
+	if cmd.MatchPlatform(armv7, armv7) <= cmd.MatchPlatform(armv7, specs.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}) {
+		t.Fatalf("MatchPlatform prefers a lower variant to the exact one")
+	}
+}
+
+// Creates an OCI image layout with a multi-platform image: an index with one
+// manifest per platform, the arm ones in a nested index.
+func makeMultiPlatformLayout(t *testing.T, ref string) string {
+	dir := t.TempDir()
+	var manifests []specs.Descriptor
+	for _, p := range []specs.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v6"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+	} {
+		layer := writeLayoutBlob(t, dir, specs.MediaTypeImageLayer, makeTar(t, map[string]string{"arch": p.Architecture + p.Variant}))
+		config := specs.Image{Platform: p, RootFS: specs.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer.Digest}}}
+		manifest := specs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: specs.MediaTypeImageManifest,
+			Config:    writeLayoutJSON(t, dir, specs.MediaTypeImageConfig, config),
+			Layers:    []specs.Descriptor{layer},
+		}
+		desc := writeLayoutJSON(t, dir, specs.MediaTypeImageManifest, manifest)
+		platform := p
+		desc.Platform = &platform
+		manifests = append(manifests, desc)
+	}
+	nested := writeLayoutJSON(t, dir, specs.MediaTypeImageIndex, specs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: specs.MediaTypeImageIndex,
+		Manifests: manifests[2:],
+	})
+	top := writeLayoutJSON(t, dir, specs.MediaTypeImageIndex, specs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: specs.MediaTypeImageIndex,
+		Manifests: append(manifests[:2:2], nested),
+	})
+	top.Annotations = map[string]string{specs.AnnotationRefName: ref}
+	data, _ := json.Marshal(specs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []specs.Descriptor{top},
+	})
+	os.WriteFile(filepath.Join(dir, "index.json"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	return dir
+}
+
+func TestInspectMultiPlatform(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.ImportLayout(makeMultiPlatformLayout(t, "multi:1"), ""); err != nil {
+		t.Fatalf("ImportLayout returned an error (%v)", err)
+	}
+	tests := []struct {
+		platform string
+		want     string
+		wantErr  bool
+	}{
+		{"linux/amd64", "linux/amd64", false},
+		{"linux/arm64", "linux/arm64/v8", false},
+		{"linux/arm/v7", "linux/arm/v7", false},
+		{"linux/arm/v6", "linux/arm/v6", false},
+		{"linux/arm/v5", "", true},
+		{"linux/s390x", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			want, _ := cmd.ParsePlatform(tt.platform)
+			image, err := cmd.InspectImage(store, "multi:1", want)
+			if tt.wantErr {
+				var e *cmd.NoMatchingPlatformError
+				if !errors.As(err, &e) {
+					t.Fatalf("InspectImage for %v returned %v, want a NoMatchingPlatformError", tt.platform, err)
+				}
+				if len(e.Available) != 4 {
+					t.Fatalf("the error lists %v platforms, want 4", len(e.Available))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("InspectImage for %v returned an error (%v)", tt.platform, err)
+			}
+			if image.Platform != tt.want || image.MediaType != specs.MediaTypeImageIndex {
+				t.Fatalf("InspectImage for %v selected %v (%v)", tt.platform, image.Platform, image.MediaType)
+			}
+		})
+	}
+}
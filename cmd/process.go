@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"rocked/specs"
+	"strings"
+
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	DEFAULT_PATH = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	entrypoint   string
+	workdir      string
+	user         string
+)
+
+// ResolveCommand builds the command of the container process from the image
+// config and the command line.
+// The entrypoint is overridden if entrypointSet is true (an empty entrypoint
+// resets it), the arguments override the image Cmd.
+// As docker does, overriding the entrypoint also drops the image Cmd.
+func ResolveCommand(config specs.ImageConfig, entrypoint string, entrypointSet bool, args []string) ([]string, error) {
+	slog.Debug("ResolveCommand", "Entrypoint", config.Entrypoint, "Cmd", config.Cmd, "entrypoint", entrypoint, "entrypointSet", entrypointSet, "args", args)
+	command := config.Entrypoint
+	cmd := config.Cmd
+	if entrypointSet {
+		command = nil
+		cmd = nil
+		if len(entrypoint) != 0 {
+			command = []string{entrypoint}
+		}
+	}
+	if len(args) != 0 {
+		cmd = args
+	}
+	command = append(append([]string{}, command...), cmd...)
+	if len(command) == 0 {
+		return nil, errors.New("no command specified and the image has no Entrypoint or Cmd")
+	}
+	return command, nil
+}
+
+// ResolveEnv builds the environment of the container process.
+// The image Env is the base (with a default PATH if it has none) and the
+// overrides replace or add variables. An override without a value (e.g. "TERM")
+// takes its value from the rocked environment, if set.
+func ResolveEnv(imageEnv, overrides []string) []string {
+	slog.Debug("ResolveEnv", "imageEnv", imageEnv, "overrides", overrides)
+	var env []string
+	index := map[string]int{}
+	set := func(entry string) {
+		key, _, _ := strings.Cut(entry, "=")
+		if i, ok := index[key]; ok {
+			env[i] = entry
+			return
+		}
+		index[key] = len(env)
+		env = append(env, entry)
+	}
+	if len(imageEnv) == 0 {
+		set(DEFAULT_PATH)
+	}
+	for _, entry := range imageEnv {
+		set(entry)
+	}
+	for _, entry := range overrides {
+		if !strings.Contains(entry, "=") {
+			value, ok := os.LookupEnv(entry)
+			if !ok {
+				continue
+			}
+			entry = entry + "=" + value
+		}
+		set(entry)
+	}
+	return env
+}
+
+// Returns the value of the variable key in the environment env
+func getEnv(env []string, key string) (string, bool) {
+	for _, entry := range env {
+		k, v, _ := strings.Cut(entry, "=")
+		if k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Adds the flags describing the container process to a command (run, create)
+func addProcessFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&envVariables, "env", "e", nil, "Sets environment variables. It can be repeated")
+	cmd.Flags().StringVarP(&image, "image", "i", "", "Use the container image (name[:tag] or name@digest)")
+	cmd.MarkFlagRequired("image")
+	cmd.Flags().StringVar(&platform, "platform", "", "Use the image for this platform (os/arch[/variant]) instead of the host one")
+	cmd.Flags().StringVar(&entrypoint, "entrypoint", "", "Overrides the image Entrypoint")
+	cmd.Flags().StringVarP(&workdir, "workdir", "w", "", "Overrides the image WorkingDir")
+	cmd.Flags().StringVarP(&user, "user", "u", "", "Overrides the image User (name, uid, name:group or uid:gid)")
+	cmd.Flags().BoolVar(&useInit, "init", false, "Run an init inside the container that forwards signals and reaps processes")
+}
@@ -0,0 +1,56 @@
+package cmd_test
+
+import (
+	"reflect"
+	"rocked/cmd"
+	"rocked/specs"
+	"testing"
+)
+
+func TestResolveCommand(t *testing.T) {
+	config := specs.ImageConfig{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+	}
+	tests := []struct {
+		name          string
+		config        specs.ImageConfig
+		entrypoint    string
+		entrypointSet bool
+		args          []string
+		want          []string
+		wantErr       bool
+	}{
+		{"image defaults", config, "", false, nil, []string{"/docker-entrypoint.sh", "nginx", "-g", "daemon off;"}, false},
+		{"args override cmd", config, "", false, []string{"bash"}, []string{"/docker-entrypoint.sh", "bash"}, false},
+		{"entrypoint override drops cmd", config, "/bin/sh", true, nil, []string{"/bin/sh"}, false},
+		{"entrypoint override with args", config, "/bin/sh", true, []string{"-c", "id"}, []string{"/bin/sh", "-c", "id"}, false},
+		{"empty entrypoint", config, "", true, []string{"id"}, []string{"id"}, false},
+		{"only cmd", specs.ImageConfig{Cmd: []string{"/bin/bash"}}, "", false, nil, []string{"/bin/bash"}, false},
+		{"nothing to run", specs.ImageConfig{}, "", false, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cmd.ResolveCommand(tt.config, tt.entrypoint, tt.entrypointSet, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	t.Setenv("ROCKED_TEST_HOST", "fromhost")
+	got := cmd.ResolveEnv([]string{"PATH=/usr/bin", "LANG=C"}, []string{"LANG=C.UTF-8", "FOO=bar", "ROCKED_TEST_HOST", "ROCKED_TEST_UNSET"})
+	want := []string{"PATH=/usr/bin", "LANG=C.UTF-8", "FOO=bar", "ROCKED_TEST_HOST=fromhost"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q want %q", got, want)
+	}
+	got = cmd.ResolveEnv(nil, nil)
+	if !reflect.DeepEqual(got, []string{cmd.DEFAULT_PATH}) {
+		t.Errorf("got %q want the default PATH", got)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	psAll    bool
+	psFormat string
+)
+
+// Formats a duration the way a human would say it ("5 minutes", "2 hours")
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return "Less than a second"
+	case d < time.Minute:
+		return fmt.Sprintf("%d seconds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+}
+
+func statusString(s *State) string {
+	switch s.Status {
+	case StatusRunning:
+		if s.Started != nil {
+			return "Up " + humanDuration(time.Since(*s.Started))
+		}
+		return "Up"
+	case StatusStopped:
+		if s.Finished != nil {
+			return fmt.Sprintf("Exited (%d) %s ago", s.ExitCode, humanDuration(time.Since(*s.Finished)))
+		}
+		return fmt.Sprintf("Exited (%d)", s.ExitCode)
+	default:
+		return "Created"
+	}
+}
+
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func printStatesTable(w io.Writer, states []*State) {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tPID")
+	for _, s := range states {
+		command := strings.Join(s.Command, " ")
+		if len(command) > 20 {
+			command = command[:19] + "…"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%q\t%s ago\t%s\t%d\n", shortId(s.Id), s.Image, command, humanDuration(time.Since(s.Created)), statusString(s), s.Pid)
+	}
+	tw.Flush()
+}
+
+func ps() {
+	states, err := ListStates(base_path)
+	if err != nil {
+		log.Fatal("Error listing the containers: ", err)
+	}
+	var shown []*State
+	for _, s := range states {
+		if psAll || s.Status == StatusRunning {
+			shown = append(shown, s)
+		}
+	}
+	switch psFormat {
+	case "json":
+		if shown == nil {
+			shown = []*State{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(shown); err != nil {
+			log.Fatal("Error encoding the containers: ", err)
+		}
+	case "table":
+		printStatesTable(os.Stdout, shown)
+	default:
+		log.Fatalf("Unknown format %q (valid formats are table and json)", psFormat)
+	}
+}
+
+// psCmd represents the ps command
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "Lists containers",
+	Long:  `Lists the running containers. Use -a to show all of them.`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ps()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(psCmd)
+	psCmd.Flags().BoolVarP(&psAll, "all", "a", false, "Show all the containers (default shows just running)")
+	psCmd.Flags().StringVar(&psFormat, "format", "table", "Output format (table or json)")
+}
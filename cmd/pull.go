@@ -0,0 +1,227 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"rocked/registry"
+	"rocked/specs"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// How many blobs are downloaded at the same time
+	PULL_CONCURRENCY = 3
+	plainHTTP        bool
+)
+
+// Returns the registry client used by the commands, with the credentials
+// of the credentials file
+func newRegistryClient() *registry.Client {
+	client := registry.NewClient()
+	client.PlainHTTP = plainHTTP
+	file, err := openAuthFile()
+	if err != nil {
+		log.Fatal("Error reading the credentials: ", err)
+	}
+	client.Credentials = file.Get
+	return client
+}
+
+// Returns the registry repository of the reference
+func registryRepository(client *registry.Client, ref Reference) *registry.Repository {
+	return client.Repository(ref.Domain(), ref.Path())
+}
+
+// PullImage pulls the image ref from its registry into the store.
+// For an image index, only the manifest best matching the platform want is
+// pulled, with the nested indexes leading to it.
+// An image pulled by tag is named after the reference, one pulled by digest
+// is stored unnamed.
+// It returns the descriptor of the image.
+func PullImage(ctx context.Context, client *registry.Client, store *ImageStore, ref Reference, want specs.Platform) (specs.Descriptor, error) {
+	slog.Debug("PullImage", "ref", ref, "platform", PlatformString(want))
+	if len(ref.Name) == 0 {
+		return specs.Descriptor{}, fmt.Errorf("invalid reference %v: a repository is needed to pull", ref)
+	}
+	// The blobs pulled aren't reachable until the image is tagged
+	unlock, err := store.lockBlobs()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer unlock()
+	repo := registryRepository(client, ref)
+	reference := ref.Tag
+	if len(ref.Digest) != 0 {
+		reference = ref.Digest.String()
+	}
+	desc, data, err := repo.Manifest(ctx, reference)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	if err := pullManifest(ctx, repo, store, desc, data, want); err != nil {
+		return specs.Descriptor{}, err
+	}
+	name := ""
+	if len(ref.Digest) == 0 {
+		name = ref.String()
+	}
+	if err := store.Tag(desc, name); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// Pulls the manifest or image index desc, whose content is data, and what it
+// references. The documents are stored after what they reference, so the
+// store never holds an incomplete image.
+func pullManifest(ctx context.Context, repo *registry.Repository, store *ImageStore, desc specs.Descriptor, data []byte, want specs.Platform) error {
+	switch {
+	case specs.IsImageIndex(desc.MediaType):
+		var index specs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("decoding the index %v: %w", desc.Digest, err)
+		}
+		if err := pullIndex(ctx, repo, store, index, want); err != nil {
+			return err
+		}
+	case specs.IsImageManifest(desc.MediaType):
+		var manifest specs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("decoding the manifest %v: %w", desc.Digest, err)
+		}
+		if err := pullBlobs(ctx, repo, store, append([]specs.Descriptor{manifest.Config}, manifest.Layers...)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported manifest media type %q", desc.MediaType)
+	}
+	return store.WriteBlob(bytes.NewReader(data), desc.Digest)
+}
+
+// Pulls the manifest of the index best matching the platform want.
+// Without a matching manifest in the index itself, the nested indexes are
+// fetched to find one, and the one leading to it stored.
+func pullIndex(ctx context.Context, repo *registry.Repository, store *ImageStore, index specs.Index, want specs.Platform) error {
+	noMatch := &NoMatchingPlatformError{Want: want}
+	var best specs.Descriptor
+	bestScore := 0
+	for _, m := range index.Manifests {
+		if !specs.IsImageManifest(m.MediaType) || m.Platform == nil {
+			continue
+		}
+		noMatch.Available = append(noMatch.Available, *m.Platform)
+		if score := MatchPlatform(want, *m.Platform); score > bestScore {
+			best = m
+			bestScore = score
+		}
+	}
+	if bestScore != 0 {
+		desc, data, err := repo.Manifest(ctx, best.Digest.String())
+		if err != nil {
+			return err
+		}
+		return pullManifest(ctx, repo, store, desc, data, want)
+	}
+	for _, m := range index.Manifests {
+		if !specs.IsImageIndex(m.MediaType) {
+			continue
+		}
+		nested, data, err := repo.Manifest(ctx, m.Digest.String())
+		if err != nil {
+			return err
+		}
+		err = pullManifest(ctx, repo, store, nested, data, want)
+		var e *NoMatchingPlatformError
+		if !errors.As(err, &e) {
+			return err
+		}
+		noMatch.Available = append(noMatch.Available, e.Available...)
+	}
+	return noMatch
+}
+
+// Pulls the blobs missing from the store, PULL_CONCURRENCY at a time
+func pullBlobs(ctx context.Context, repo *registry.Repository, store *ImageStore, blobs []specs.Descriptor) error {
+	sem := make(chan struct{}, PULL_CONCURRENCY)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	seen := map[string]bool{}
+	for _, blob := range blobs {
+		if seen[blob.Digest.String()] {
+			continue
+		}
+		seen[blob.Digest.String()] = true
+		if store.HasBlob(blob.Digest) {
+			if store.Progress != nil {
+				fmt.Fprintf(store.Progress, "%s: already exists\n", shortId(blob.Digest.Encoded()))
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(blob specs.Descriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			fetch := func(offset int64) (io.ReadCloser, int64, error) {
+				return repo.FetchBlob(ctx, blob, offset)
+			}
+			if err := store.IngestBlob(blob, fetch, store.blobProgress(blob, "downloading", "downloaded")); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("pulling the blob %v: %w", blob.Digest, err))
+				mu.Unlock()
+			}
+		}(blob)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func pullImage(image, platform string) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		log.Fatal(err)
+	}
+	want, err := selectedPlatform(platform)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := openImageStore()
+	store.Progress = os.Stderr
+	desc, err := PullImage(context.Background(), newRegistryClient(), store, ref, want)
+	if err != nil {
+		log.Fatal("Error pulling ", ref, ": ", err)
+	}
+	fmt.Println("Digest:", desc.Digest)
+	fmt.Println("Pulled:", ref)
+}
+
+// pullCmd represents the pull command
+var pullCmd = &cobra.Command{
+	Use:   "pull <image>",
+	Short: "Pulls an image from a registry",
+	Long: `Pulls an image from a registry implementing the OCI distribution spec.
+The names without a registry, e.g. fedora:40, are pulled from docker.io.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pullImage(args[0], platform)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pullCmd)
+	pullCmd.Flags().StringVar(&platform, "platform", "", "Pull the image for this platform (os/arch[/variant]) instead of the host one")
+	pullCmd.Flags().BoolVar(&plainHTTP, "plain-http", false, "Use http instead of https to talk to the registry")
+}
@@ -0,0 +1,199 @@
+package cmd_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rocked/cmd"
+	"rocked/registry"
+	"rocked/registry/registrytest"
+	"rocked/specs"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Serves the OCI image layout dir as the repository repo of a test registry.
+// It returns the registry, and a client trusting it.
+func serveLayout(t *testing.T, reg *registrytest.Registry, repo, dir string) (string, *registry.Client) {
+	if err := reg.LoadLayout(repo, dir); err != nil {
+		t.Fatalf("LoadLayout returned an error (%v)", err)
+	}
+	srv := registrytest.NewServer(t, reg)
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	return registrytest.Host(srv), client
+}
+
+func TestPullImage(t *testing.T) {
+	layers := [][]byte{
+		makeTar(t, map[string]string{"etc/os-release": "fedora"}),
+		makeTar(t, map[string]string{"bin/sh": strings.Repeat("shell", 1000)}),
+	}
+	reg := registrytest.New()
+	// Every blob download is cut once, and resumed
+	reg.FailAfter = 1024
+	host, client := serveLayout(t, reg, "test/fedora", makeLayout(t, "40", layers...))
+	store := newTestStore(t)
+
+	ref, _ := cmd.ParseReference(host + "/test/fedora:40")
+	desc, err := cmd.PullImage(context.Background(), client, store, ref, cmd.HostPlatform())
+	if err != nil {
+		t.Fatalf("PullImage returned an error (%v)", err)
+	}
+	resumed := slices.ContainsFunc(reg.Requests(), func(r string) bool {
+		return strings.HasSuffix(r, "bytes=1024-")
+	})
+	if !resumed {
+		t.Fatalf("the interrupted download was not resumed: %v", reg.Requests())
+	}
+	found, err := store.Lookup(host + "/test/fedora:40")
+	if err != nil || found.Digest != desc.Digest {
+		t.Fatalf("Lookup returned %v (%v), want %v", found.Digest, err, desc.Digest)
+	}
+	unpacked, err := unpackImage(t, store, host+"/test/fedora:40")
+	if err != nil {
+		t.Fatalf("Unpack returned an error (%v)", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(unpacked[0], "etc/os-release")); err != nil || string(data) != "fedora" {
+		t.Fatalf("the pulled layer has etc/os-release %q (%v)", data, err)
+	}
+	if _, errs := store.Verify(nil); len(errs) != 0 {
+		t.Fatalf("the pulled image is corrupted (%v)", errs)
+	}
+
+	// By digest, the image is already there
+	ref, _ = cmd.ParseReference(host + "/test/fedora@" + desc.Digest.String())
+	before := len(reg.Requests())
+	if _, err := cmd.PullImage(context.Background(), client, store, ref, cmd.HostPlatform()); err != nil {
+		t.Fatalf("PullImage by digest returned an error (%v)", err)
+	}
+	for _, r := range reg.Requests()[before:] {
+		if strings.Contains(r, "/blobs/") {
+			t.Fatalf("a blob was downloaded again: %v", r)
+		}
+	}
+}
+
+func TestPullImageGarbageCollect(t *testing.T) {
+	layers := [][]byte{
+		makeTar(t, map[string]string{"etc/os-release": "fedora"}),
+		makeTar(t, map[string]string{"bin/sh": "shell"}),
+	}
+	dir := makeLayout(t, "40", layers...)
+	reg := registrytest.New()
+	if err := reg.LoadLayout("test/fedora", dir); err != nil {
+		t.Fatalf("LoadLayout returned an error (%v)", err)
+	}
+	// The download of the second layer waits for release
+	blocked := digest.FromBytes(layers[1]).String()
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/blobs/"+blocked) {
+			once.Do(func() { close(fetching) })
+			<-release
+		}
+		reg.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	var releaseOnce sync.Once
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+
+	// The config and the first layer are in the store, but not reachable
+	store := newTestStore(t)
+	if _, err := store.ImportLayout(dir, ""); err != nil {
+		t.Fatalf("ImportLayout returned an error (%v)", err)
+	}
+	if err := store.Untag("40"); err != nil {
+		t.Fatalf("Untag returned an error (%v)", err)
+	}
+	if err := os.Remove(store.BlobPath(digest.FromBytes(layers[1]))); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, _ := cmd.ParseReference(registrytest.Host(srv) + "/test/fedora:40")
+	pulled := make(chan error, 1)
+	go func() {
+		_, err := cmd.PullImage(context.Background(), client, store, ref, cmd.HostPlatform())
+		pulled <- err
+	}()
+	<-fetching
+	collected := make(chan error, 1)
+	go func() {
+		_, _, err := store.GarbageCollect(nil)
+		collected <- err
+	}()
+	select {
+	case err := <-collected:
+		t.Fatalf("GarbageCollect returned (%v) while the pull was in progress", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	releaseOnce.Do(func() { close(release) })
+	if err := <-pulled; err != nil {
+		t.Fatalf("PullImage returned an error (%v)", err)
+	}
+	if err := <-collected; err != nil {
+		t.Fatalf("GarbageCollect returned an error (%v)", err)
+	}
+	if _, errs := store.Verify(nil); len(errs) != 0 {
+		t.Fatalf("the pulled image is incomplete (%v)", errs)
+	}
+}
+
+func TestPullImageIndex(t *testing.T) {
+	reg := registrytest.New()
+	reg.Username, reg.Password = "user", "secret"
+	host, client := serveLayout(t, reg, "multi", makeMultiPlatformLayout(t, "latest"))
+	store := newTestStore(t)
+	ref, _ := cmd.ParseReference(host + "/multi")
+	want, _ := cmd.ParsePlatform("linux/arm/v7")
+
+	if _, err := cmd.PullImage(context.Background(), client, store, ref, want); err == nil {
+		t.Fatalf("PullImage succeeded without credentials")
+	}
+	client.Credentials = func(string) (string, string, error) { return "user", "secret", nil }
+	if _, err := cmd.PullImage(context.Background(), client, store, ref, want); err != nil {
+		t.Fatalf("PullImage returned an error (%v)", err)
+	}
+	image, err := cmd.InspectImage(store, host+"/multi", want)
+	if err != nil {
+		t.Fatalf("InspectImage returned an error (%v)", err)
+	}
+	if image.Platform != "linux/arm/v7" {
+		t.Fatalf("the pulled image is for %v, want linux/arm/v7", image.Platform)
+	}
+	// Only the manifest of the platform was pulled
+	other, _ := cmd.ParsePlatform("linux/amd64")
+	var noMatch *cmd.NoMatchingPlatformError
+	if _, err := cmd.InspectImage(store, host+"/multi", other); !errors.As(err, &noMatch) {
+		t.Fatalf("InspectImage for another platform returned %v, want NoMatchingPlatformError", err)
+	}
+
+	want, _ = cmd.ParsePlatform("linux/s390x")
+	if _, err := cmd.PullImage(context.Background(), client, store, ref, want); !errors.As(err, &noMatch) {
+		t.Fatalf("PullImage for a missing platform returned %v, want NoMatchingPlatformError", err)
+	}
+	if len(noMatch.Available) != 4 {
+		t.Fatalf("the error lists %v platforms, want 4", noMatch.Available)
+	}
+}
+
+func TestPullImageNotFound(t *testing.T) {
+	host, client := serveLayout(t, registrytest.New(), "test", makeLayout(t, "v1", makeTar(t, map[string]string{"a": "a"})))
+	ref, _ := cmd.ParseReference(host + "/test:v2")
+	_, err := cmd.PullImage(context.Background(), client, newTestStore(t), ref, specs.Platform{OS: "linux", Architecture: "amd64"})
+	if !registry.IsNotFound(err) {
+		t.Fatalf("PullImage returned %v, want a not found error", err)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"rocked/registry"
+	"rocked/specs"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// How many blobs are uploaded at the same time
+	PUSH_CONCURRENCY = 3
+)
+
+// pusher pushes the content of the store to a registry repository
+type pusher struct {
+	store *ImageStore
+	repo  *registry.Repository
+	// The repository of the same registry the blobs may be mounted from
+	mountFrom string
+	// The platform of the manifest pushed for an incomplete image index
+	platform specs.Platform
+}
+
+// PushImage pushes the image src of the store to the registry of dest.
+// The blobs missing from the repository are uploaded, or mounted from the
+// repository of src when it is on the same registry, then the manifests.
+// An image index whose manifests aren't all in the store (e.g. pulled for a
+// single platform) can't be pushed whole: its manifest for the platform
+// want is pushed instead.
+// It returns the descriptor of the manifest or index pushed.
+func PushImage(ctx context.Context, client *registry.Client, store *ImageStore, src string, dest Reference, want specs.Platform) (specs.Descriptor, error) {
+	slog.Debug("PushImage", "src", src, "dest", dest, "platform", PlatformString(want))
+	if len(dest.Name) == 0 {
+		return specs.Descriptor{}, fmt.Errorf("invalid destination %v: a repository is needed to push", dest)
+	}
+	// The image may be removed meanwhile, not its blobs
+	unlock, err := store.lockBlobs()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer unlock()
+	desc, err := store.Lookup(src)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	p := &pusher{store: store, repo: registryRepository(client, dest), platform: want}
+	if srcRef, err := ParseReference(src); err == nil && len(srcRef.Name) != 0 {
+		if srcRepo := registryRepository(client, srcRef); srcRepo.Host == p.repo.Host && srcRepo.Name != p.repo.Name {
+			p.mountFrom = srcRepo.Name
+		}
+	}
+	if specs.IsImageIndex(desc.MediaType) && !p.complete(desc) {
+		manifest, err := store.ResolveManifest(desc, want)
+		if err != nil {
+			return specs.Descriptor{}, err
+		}
+		if store.Progress != nil {
+			fmt.Fprintf(store.Progress, "The image index is incomplete, pushing its manifest for %v\n", PlatformString(want))
+		}
+		desc = manifest
+	}
+	if len(dest.Digest) != 0 && dest.Digest != desc.Digest {
+		return specs.Descriptor{}, fmt.Errorf("the image %v is %v, not %v", src, desc.Digest, dest.Digest)
+	}
+	reference := dest.Tag
+	if len(reference) == 0 {
+		reference = desc.Digest.String()
+	}
+	if err := p.push(ctx, desc, reference); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// Tells if all the manifests the image index desc references are in the store
+func (p *pusher) complete(desc specs.Descriptor) bool {
+	var index specs.Index
+	if err := p.store.readJSONBlob(desc, &index); err != nil {
+		return false
+	}
+	for _, m := range index.Manifests {
+		if !p.store.HasBlob(m.Digest) {
+			return false
+		}
+		if specs.IsImageIndex(m.MediaType) && !p.complete(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// Pushes the manifest or image index desc as reference, after what it
+// references
+func (p *pusher) push(ctx context.Context, desc specs.Descriptor, reference string) error {
+	r, err := p.store.OpenBlob(desc)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	switch {
+	case specs.IsImageIndex(desc.MediaType):
+		var index specs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return err
+		}
+		for _, m := range index.Manifests {
+			if err := p.push(ctx, m, m.Digest.String()); err != nil {
+				return err
+			}
+		}
+	case specs.IsImageManifest(desc.MediaType):
+		var manifest specs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return err
+		}
+		if err := p.pushBlobs(ctx, append([]specs.Descriptor{manifest.Config}, manifest.Layers...)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported manifest media type %q", desc.MediaType)
+	}
+	d, err := p.repo.PushManifest(ctx, reference, desc.MediaType, data)
+	if err != nil {
+		return fmt.Errorf("pushing the manifest %v: %w", desc.Digest, err)
+	}
+	slog.Debug("PushImage: pushed manifest", "digest", d, "reference", reference)
+	return nil
+}
+
+// Pushes the blobs missing from the repository, PUSH_CONCURRENCY at a time
+func (p *pusher) pushBlobs(ctx context.Context, blobs []specs.Descriptor) error {
+	sem := make(chan struct{}, PUSH_CONCURRENCY)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	seen := map[string]bool{}
+	for _, blob := range blobs {
+		if seen[blob.Digest.String()] {
+			continue
+		}
+		seen[blob.Digest.String()] = true
+		wg.Add(1)
+		go func(blob specs.Descriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := p.pushBlob(ctx, blob); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("pushing the blob %v: %w", blob.Digest, err))
+				mu.Unlock()
+			}
+		}(blob)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Pushes the blob, unless the repository has it or can mount it
+func (p *pusher) pushBlob(ctx context.Context, blob specs.Descriptor) error {
+	id := shortId(blob.Digest.Encoded())
+	report := func(status string) {
+		if p.store.Progress != nil {
+			fmt.Fprintf(p.store.Progress, "%s: %s\n", id, status)
+		}
+	}
+	exists, err := p.repo.BlobExists(ctx, blob)
+	if err != nil {
+		return err
+	}
+	if exists {
+		report("already exists")
+		return nil
+	}
+	if len(p.mountFrom) != 0 {
+		mounted, err := p.repo.MountBlob(ctx, blob, p.mountFrom)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			report("mounted from " + p.mountFrom)
+			return nil
+		}
+	}
+	// Verified while uploaded, a corrupted blob is never committed
+	r, err := p.store.OpenBlob(blob)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := p.repo.PushBlob(ctx, blob, r); err != nil {
+		return err
+	}
+	report("pushed " + humanSize(blob.Size))
+	return nil
+}
+
+func pushImage(src, dest, platform string) {
+	if len(dest) == 0 {
+		dest = src
+	}
+	ref, err := ParseReference(dest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	want, err := selectedPlatform(platform)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := openImageStore()
+	store.Progress = os.Stderr
+	desc, err := PushImage(context.Background(), newRegistryClient(), store, src, ref, want)
+	if err != nil {
+		log.Fatal("Error pushing ", src, " to ", ref, ": ", err)
+	}
+	fmt.Println("Digest:", desc.Digest)
+	fmt.Println("Pushed:", ref)
+}
+
+// pushCmd represents the push command
+var pushCmd = &cobra.Command{
+	Use:   "push <image> [destination]",
+	Short: "Pushes an image to a registry",
+	Long: `Pushes an image of the store to a registry implementing the OCI distribution spec.
+The image is pushed to the registry and repository of its name, or of the destination if given.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dest := ""
+		if len(args) == 2 {
+			dest = args[1]
+		}
+		pushImage(args[0], dest, platform)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pushCmd)
+	pushCmd.Flags().StringVar(&platform, "platform", "", "Push the manifest for this platform (os/arch[/variant]) of an incomplete image index, instead of the host one")
+	pushCmd.Flags().BoolVar(&plainHTTP, "plain-http", false, "Use http instead of https to talk to the registry")
+}
@@ -0,0 +1,113 @@
+package cmd_test
+
+import (
+	"context"
+	"rocked/cmd"
+	"rocked/registry"
+	"rocked/registry/registrytest"
+	"rocked/specs"
+	"strings"
+	"testing"
+)
+
+// Returns the requests of reg received since the first ones
+func requestsSince(reg *registrytest.Registry, first int) []string {
+	return reg.Requests()[first:]
+}
+
+func countRequests(requests []string, prefix string) int {
+	n := 0
+	for _, r := range requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPushImage(t *testing.T) {
+	reg := registrytest.New()
+	reg.Username, reg.Password = "user", "secret"
+	srv := registrytest.NewServer(t, reg)
+	host := registrytest.Host(srv)
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	client.Credentials = func(string) (string, string, error) { return "user", "secret", nil }
+	client.ChunkSize = 1000
+
+	store := newTestStore(t)
+	layer := makeTar(t, map[string]string{"bin/sh": strings.Repeat("shell", 1000)})
+	store.ImportLayout(makeLayout(t, "fedora:40", layer), "")
+	original, _ := store.Lookup("fedora:40")
+
+	dest, _ := cmd.ParseReference(host + "/test/fedora:40")
+	desc, err := cmd.PushImage(context.Background(), client, store, "fedora:40", dest, cmd.HostPlatform())
+	if err != nil {
+		t.Fatalf("PushImage returned an error (%v)", err)
+	}
+	if desc.Digest != original.Digest {
+		t.Fatalf("PushImage pushed %v, want %v", desc.Digest, original.Digest)
+	}
+	if _, _, ok := reg.Manifest("test/fedora", "40"); !ok {
+		t.Fatalf("the registry has no manifest tagged 40")
+	}
+	// The layer is larger than a chunk
+	if countRequests(reg.Requests(), "PATCH /v2/test/fedora/blobs/uploads/") < 2 {
+		t.Fatalf("the layer was not uploaded in chunks: %v", reg.Requests())
+	}
+
+	// Pushed again, only the manifest is sent
+	first := len(reg.Requests())
+	if _, err := cmd.PushImage(context.Background(), client, store, "fedora:40", dest, cmd.HostPlatform()); err != nil {
+		t.Fatalf("a second PushImage returned an error (%v)", err)
+	}
+	if n := countRequests(requestsSince(reg, first), "POST"); n != 0 {
+		t.Fatalf("%v uploads were started for blobs the registry has", n)
+	}
+
+	// Pulled back, the image is the same
+	other := newTestStore(t)
+	pulled, err := cmd.PullImage(context.Background(), client, other, dest, cmd.HostPlatform())
+	if err != nil {
+		t.Fatalf("PullImage returned an error (%v)", err)
+	}
+	if pulled.Digest != original.Digest {
+		t.Fatalf("the pulled image is %v, want %v", pulled.Digest, original.Digest)
+	}
+	if _, errs := other.Verify(nil); len(errs) != 0 {
+		t.Fatalf("the pulled image is corrupted (%v)", errs)
+	}
+}
+
+func TestPushImageMount(t *testing.T) {
+	reg := registrytest.New()
+	host, client := serveLayout(t, reg, "multi", makeMultiPlatformLayout(t, "latest"))
+	store := newTestStore(t)
+	src, _ := cmd.ParseReference(host + "/multi")
+	want, _ := cmd.ParsePlatform("linux/arm64")
+	if _, err := cmd.PullImage(context.Background(), client, store, src, want); err != nil {
+		t.Fatalf("PullImage returned an error (%v)", err)
+	}
+	index, _ := store.Lookup(host + "/multi")
+	manifest, _ := store.ResolveManifest(index, want)
+
+	first := len(reg.Requests())
+	dest, _ := cmd.ParseReference(host + "/copy:arm64")
+	desc, err := cmd.PushImage(context.Background(), client, store, host+"/multi", dest, want)
+	if err != nil {
+		t.Fatalf("PushImage returned an error (%v)", err)
+	}
+	// Only the manifest of the platform is in the store
+	if desc.Digest != manifest.Digest {
+		t.Fatalf("PushImage pushed %v, want the arm64 manifest %v", desc.Digest, manifest.Digest)
+	}
+	mediaType, _, ok := reg.Manifest("copy", "arm64")
+	if !ok || mediaType != specs.MediaTypeImageManifest {
+		t.Fatalf("the registry has the manifest %v (%v)", mediaType, ok)
+	}
+	// The blobs are mounted from the source repository, not uploaded
+	requests := requestsSince(reg, first)
+	if countRequests(requests, "POST /v2/copy/blobs/uploads/") != 2 || countRequests(requests, "PUT /v2/copy/blobs/uploads/") != 0 {
+		t.Fatalf("the blobs were not mounted: %v", requests)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	DEFAULT_TAG = "latest"
+	// The components of a repository name: lowercase alphanumeric, separated
+	// by a period, one or two underscores or one or more dashes.
+	referencePathComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*$`)
+	referenceTag           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	// A registry host, with an optional port
+	referenceDomain = regexp.MustCompile(`^(?:[A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9-]*[A-Za-z0-9])(?:\.(?:[A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9-]*[A-Za-z0-9]))*(?::[0-9]+)?$`)
+)
+
+// Reference is an image reference, e.g. fedora:39, quay.io/fedora/fedora:39
+// or fedora@sha256:<hex>.
+// At least one of Name and Digest is set.
+type Reference struct {
+	// The repository name, including the registry domain if any
+	Name string
+	Tag  string
+	// Set when the tag was not given and defaults to latest
+	implicitTag bool
+	Digest      digest.Digest
+}
+
+// ParseReference parses an image reference: [domain[:port]/]path[:tag][@digest]
+// or a bare digest.
+// Without a tag and a digest, the tag is latest.
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	if len(s) == 0 {
+		return ref, fmt.Errorf("invalid reference: empty")
+	}
+	if d, err := digest.Parse(s); err == nil {
+		ref.Digest = d
+		return ref, nil
+	}
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		d, err := digest.Parse(name[i+1:])
+		if err != nil {
+			return ref, fmt.Errorf("invalid reference %q: %w", s, err)
+		}
+		ref.Digest = d
+		name = name[:i]
+	}
+	// The tag follows the last colon, unless it belongs to the domain port
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if !referenceTag.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid reference %q: invalid tag %q", s, ref.Tag)
+		}
+	}
+	components := strings.Split(name, "/")
+	if len(components) > 1 && isDomain(components[0]) {
+		if !referenceDomain.MatchString(components[0]) {
+			return ref, fmt.Errorf("invalid reference %q: invalid domain %q", s, components[0])
+		}
+		components = components[1:]
+	}
+	for _, c := range components {
+		if !referencePathComponent.MatchString(c) {
+			return ref, fmt.Errorf("invalid reference %q: invalid repository name %q", s, name)
+		}
+	}
+	ref.Name = name
+	if len(ref.Tag) == 0 && len(ref.Digest) == 0 {
+		ref.Tag = DEFAULT_TAG
+		ref.implicitTag = true
+	}
+	return ref, nil
+}
+
+// As docker does, the first component of a name is a domain if it has a
+// period or a port, or is localhost.
+func isDomain(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// Domain returns the registry domain of the reference, empty if it has none
+func (r Reference) Domain() string {
+	if i := strings.Index(r.Name, "/"); i >= 0 && isDomain(r.Name[:i]) {
+		return r.Name[:i]
+	}
+	return ""
+}
+
+// Path returns the repository name without the domain
+func (r Reference) Path() string {
+	if domain := r.Domain(); len(domain) != 0 {
+		return r.Name[len(domain)+1:]
+	}
+	return r.Name
+}
+
+// String returns the canonical form of the reference: name:tag, name@digest,
+// name:tag@digest or the bare digest.
+func (r Reference) String() string {
+	s := r.Name
+	if len(r.Tag) != 0 {
+		s += ":" + r.Tag
+	}
+	if len(r.Digest) != 0 {
+		if len(s) != 0 {
+			s += "@"
+		}
+		s += r.Digest.String()
+	}
+	return s
+}
+
+// Returns the ref names the reference matches in an index: name:tag and, if the
+// tag was not given, the bare name.
+func (r Reference) refNames() []string {
+	if len(r.Name) == 0 {
+		return nil
+	}
+	names := []string{r.Name + ":" + r.Tag}
+	if r.implicitTag {
+		names = append(names, r.Name)
+	}
+	return names
+}
@@ -0,0 +1,91 @@
+package cmd_test
+
+import (
+	"rocked/cmd"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	hex := "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	tests := []struct {
+		ref     string
+		want    string
+		domain  string
+		path    string
+		wantErr bool
+	}{
+		{"fedora", "fedora:latest", "", "fedora", false},
+		{"fedora:39", "fedora:39", "", "fedora", false},
+		{"library/fedora:39", "library/fedora:39", "", "library/fedora", false},
+		{"quay.io/fedora/fedora:39", "quay.io/fedora/fedora:39", "quay.io", "fedora/fedora", false},
+		{"localhost:5000/busybox", "localhost:5000/busybox:latest", "localhost:5000", "busybox", false},
+		{"localhost/busybox:1.36", "localhost/busybox:1.36", "localhost", "busybox", false},
+		{"fedora@" + hex, "fedora@" + hex, "", "fedora", false},
+		{"fedora:39@" + hex, "fedora:39@" + hex, "", "fedora", false},
+		{hex, hex, "", "", false},
+		{"my-app/web__x.v2:v1.0-rc", "my-app/web__x.v2:v1.0-rc", "", "my-app/web__x.v2", false},
+		{"", "", "", "", true},
+		{"Fedora", "", "", "", true},
+		{"fedora:", "", "", "", true},
+		{"fedora:bad/tag", "", "", "", true},
+		{"fedora@sha256:123", "", "", "", true},
+		{"fedora//39", "", "", "", true},
+		{"-fedora", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			ref, err := cmd.ParseReference(tt.ref)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseReference(%q) = %v, want an error", tt.ref, ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseReference(%q) returned an error (%v)", tt.ref, err)
+			}
+			if ref.String() != tt.want || ref.Domain() != tt.domain || ref.Path() != tt.path {
+				t.Fatalf("ParseReference(%q) = %v (domain %q, path %q), want %v (domain %q, path %q)",
+					tt.ref, ref, ref.Domain(), ref.Path(), tt.want, tt.domain, tt.path)
+			}
+		})
+	}
+}
+
+func TestImageStoreResolve(t *testing.T) {
+	store := newTestStore(t)
+	layer := makeTar(t, map[string]string{"a": "a"})
+	imported, _ := store.ImportLayout(makeLayout(t, "fedora:39", layer), "")
+	store.ImportLayout(makeLayout(t, "fedora", layer, makeTar(t, map[string]string{"b": "b"})), "")
+	latest, _ := store.Lookup("fedora:latest")
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{"fedora:39", imported[0].Digest.String(), false},
+		{"fedora", latest.Digest.String(), false},
+		{"fedora@" + imported[0].Digest.String(), imported[0].Digest.String(), false},
+		{"other@" + imported[0].Digest.String(), imported[0].Digest.String(), false},
+		{imported[0].Digest.String(), imported[0].Digest.String(), false},
+		{"fedora:40", "", true},
+		{"fedora@sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			desc, err := store.Lookup(tt.ref)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Lookup(%q) = %v, want an error", tt.ref, desc.Digest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Lookup(%q) returned an error (%v)", tt.ref, err)
+			}
+			if desc.Digest.String() != tt.want {
+				t.Fatalf("Lookup(%q) = %v, want %v", tt.ref, desc.Digest, tt.want)
+			}
+		})
+	}
+}
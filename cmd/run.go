@@ -8,7 +8,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"rocked/utils"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"unsafe"
 
 	"log/slog"
 
@@ -18,7 +24,11 @@ import (
 var (
 	envVariables []string
 	image        string
+	detach       bool
+	stopTimeout  int
 	base_path    string = "/tmp/containers/"
+	// Signals relayed by run to the container process
+	RUN_FORWARDED_SIGNALS = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
 )
 
 func mount_virtfs(path string) syscall.Errno {
@@ -90,24 +100,51 @@ func copy(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
+// Returns the overlay lowerdir option for the image layers.
+// Overlay stacks the lower directories from the right, so the top-most
+// layer comes first.
+func overlayLowerDirs(layers []string) string {
+	dirs := make([]string, len(layers))
+	for i, layer := range layers {
+		dirs[len(layers)-1-i] = layer
+	}
+	return strings.Join(dirs, ":")
+}
+
+// Options for the creation of the container process
+type forkOptions struct {
+	// If not empty, the child blocks on this fifo just before the exec
+	// until someone opens it for reading (see start). In this case the parent
+	// doesn't wait for the exec to happen.
+	execFifo string
+	// If not empty, the slave side of the pseudo-terminal of the container
+	ttySlave string
+	// Keep the standard input open
+	interactive bool
+}
+
 // This function should basically do all the work for the child process.
 // It should not be able to return, but only execute the process invoked.
+// The parent gets the pid of the child and a pidfd referring to it.
+// The child doesn't share the file descriptors table with the parent, as it
+// rearranges its standard input, output and error.
 //
 //go:noinline
 //go:norace
 //go:nocheckptr
-func runFork(base_path, image string, args []string) (int, syscall.Errno) {
-	slog.Debug("runFork", "base_path", base_path, "image", image, "args", args)
-	// Untar the container image into a predefined root
-	// For now let's use hardocded paths
-	con, errc := SetContainer(image, base_path)
-	if errc != nil {
-		log.Fatal("Error trying to setup container ", ": ", errc)
-	}
+func runFork(con *Container, state *State, opts forkOptions) (int, int, syscall.Errno) {
+	args := state.Command
+	execFifo := opts.execFifo
+	slog.Debug("runFork", "path", con.Path, "args", args, "options", opts)
 	cargs := CloneArgs{
-		flags: CLONE_VFORK | CLONE_FILES | CLONE_NEWPID | CLONE_NEWNET | CLONE_INTO_CGROUP,
+		flags: CLONE_VFORK | CLONE_NEWPID | CLONE_NEWNET | CLONE_INTO_CGROUP,
+	}
+	if len(execFifo) != 0 {
+		// The parent must keep going while the child waits on the fifo,
+		// so it can't be suspended until the exec.
+		cargs.flags = CLONE_NEWPID | CLONE_NEWNET | CLONE_INTO_CGROUP
 	}
-	slog.Debug("runFork", "base_path", base_path, "image", image, "cargs flags", cargs.flags, "cargs cg fd", cargs.cgroup)
+	slog.Debug("runFork", "path", con.Path, "cargs flags", cargs.flags, "cargs cg fd", cargs.cgroup)
 	cgroup, errCG := PrepareCgroup(con, &cargs)
 	if errCG != nil {
 		log.Fatal("Error while setting up cgroups: ", "id", cgroup.Id, "err", errCG)
@@ -124,15 +161,19 @@ func runFork(base_path, image string, args []string) (int, syscall.Errno) {
 	cargs.cgroup = uint64(cgFile.Fd())
 	cgroup.SetCGLimits()
 	defer cgFile.Fd()
+	// The kernel stores the pidfd in the parent memory
+	var pidfd int32 = -1
+	cargs.flags |= CLONE_PIDFD
+	cargs.pidFD = uint64(uintptr(unsafe.Pointer(&pidfd)))
 	// Let's create the child process
 	pid, err := Fork(&cargs)
 	if err != 0 {
 		fmt.Printf("Error forking: %v", int(err))
-		return -1, err
+		return -1, -1, err
 	}
 	//Parent
 	if pid != 0 {
-		return int(pid), 0
+		return int(pid), int(pidfd), 0
 	}
 
 	slog.Debug("Child", "pid", pid, "pid thread", os.Getpid(), "pid parent", os.Getppid())
@@ -151,10 +192,9 @@ func runFork(base_path, image string, args []string) (int, syscall.Errno) {
 		log.Println("Error trying to set the hostname ", err)
 	}
 	mergepath := con.Path + "/overlay/merge"
-	err = Mount("overlay", mergepath, "overlay", MS_MGC_VAL, "lowerdir="+con.Path+"/image_root/,upperdir="+con.Path+"/overlay/upper,workdir="+con.Path+"/overlay/work")
+	err = Mount("overlay", mergepath, "overlay", MS_MGC_VAL, "lowerdir="+overlayLowerDirs(state.Layers)+",upperdir="+con.Path+"/overlay/upper,workdir="+con.Path+"/overlay/work")
 	if err != 0 {
-		log.Printf("Error mounting overlay on the directory %v: %v", mergepath, err)
-		return -1, err
+		log.Fatalf("Error mounting overlay on the directory %v: %v", mergepath, err)
 	}
 	log.Println("Created a new root fs for our container :", con.Path+"/overlay/")
 	//// This is to temporally have a mountpoint for pivot_root
@@ -164,9 +204,33 @@ func runFork(base_path, image string, args []string) (int, syscall.Errno) {
 	//}
 
 	err = mount_virtfs(mergepath)
-	defer umount_virtfs(mergepath)
 	if err != 0 {
-		return -1, err
+		log.Fatal("Error mounting the virtual file systems in ", mergepath, ": ", err)
+	}
+	// The rocked binary won't be reachable anymore after pivot_root,
+	// keep a reference to it to execute the init.
+	initfd := -1
+	if state.Init {
+		initfd, err = Open("/proc/self/exe", syscall.O_RDONLY|syscall.O_CLOEXEC)
+		if err != 0 {
+			log.Fatal("Error opening the rocked binary: ", err)
+		}
+	}
+	// Same for the terminal, /dev/pts is not mounted in the container
+	ttyfd := -1
+	if len(opts.ttySlave) != 0 {
+		ttyfd, err = Open(opts.ttySlave, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC)
+		if err != 0 {
+			log.Fatal("Error opening the terminal ", opts.ttySlave, ": ", err)
+		}
+	}
+	// The fifo won't be reachable anymore after pivot_root, keep a reference to it.
+	fifofd := -1
+	if len(execFifo) != 0 {
+		fifofd, err = Open(execFifo, O_PATH|syscall.O_CLOEXEC)
+		if err != 0 {
+			log.Fatal("Error opening the exec fifo ", execFifo, ": ", err)
+		}
 	}
 	err = Chdir(mergepath)
 	if err != 0 {
@@ -181,44 +245,242 @@ func runFork(base_path, image string, args []string) (int, syscall.Errno) {
 		log.Fatal("Error trying to umount '.'", err)
 	}
 
+	execProcess(state, initfd, fifofd, ttyfd, opts.interactive)
+	return 0, -1, 0
+}
+
+// execProcess executes the container process described by state, in the child,
+// once it is inside the container root and namespaces.
+// It resolves the user, waits on the exec fifo (if fifofd >= 0), sets up the
+// standard input, output and error and switches to the user before executing
+// the command, through the init if initfd >= 0.
+// It doesn't return.
+func execProcess(state *State, initfd, fifofd, ttyfd int, interactive bool) {
+	// The user must be resolved with the container /etc/passwd and /etc/group
+	execUser, erru := utils.ResolveUser(state.User, "/etc/passwd", "/etc/group")
+	if erru != nil {
+		log.Fatal("Error resolving the user ", state.User, ": ", erru)
+	}
+	a := processExecArgs(state, execUser)
+	if initfd >= 0 {
+		// Run the command through the rocked init, executed from its file descriptor
+		if err := CheckInitLoader("/proc/self/fd/"+strconv.Itoa(initfd), "/"); err != nil {
+			log.Fatal("Error running the init: ", err)
+		}
+		a.Exeargs = append([]string{"rocked-init", "init", "--", a.Exe}, a.Exeargs[1:]...)
+		a.Exe = "/proc/self/fd/" + strconv.Itoa(initfd)
+	}
+
+	if fifofd >= 0 {
+		waitExecFifo(fifofd)
+	}
+	setupStdio(ttyfd, interactive)
+	err := SwitchUser(execUser)
+	if err != 0 {
+		log.Fatal("Error switching to the user ", state.User, ": ", err)
+	}
+
 	// Exec
-	a := ExecArgs{
-		Exe:     args[0],
-		Exeargs: args,
+	err = Exec(a)
+	if err != 0 {
+		log.Fatal("Error executing ", state.Command[0], ": ", err)
+	}
+}
+
+// Prepares the exec of the container process, once in the container root:
+// it moves into the working directory, sets HOME and looks up the executable.
+func processExecArgs(state *State, execUser *utils.ExecUser) *ExecArgs {
+	cwd := state.Cwd
+	if len(cwd) == 0 {
+		cwd = "/"
+	}
+	// As docker does, create the working directory if it's missing
+	os.MkdirAll(cwd, 0755)
+	err := Chdir(cwd)
+	if err != 0 {
+		log.Fatal("Error trying to chdir into ", cwd, ": ", err)
+	}
+	env := state.Env
+	if _, ok := getEnv(env, "HOME"); !ok {
+		env = append(env, "HOME="+execUser.Home)
 	}
-	a.Env = os.Environ()
-	for _, entry := range envVariables {
-		a.Env = append(a.Env, entry)
+	path, _ := getEnv(env, "PATH")
+	exe, erre := utils.LookPath(state.Command[0], path)
+	if erre != nil {
+		log.Fatal("Error executing ", state.Command[0], ": ", erre)
 	}
-	err = Exec(&a)
+	return &ExecArgs{
+		Exe:     exe,
+		Exeargs: state.Command,
+		Env:     env,
+	}
+}
+
+// Blocks until the container is started.
+// Opening the fifo for writing blocks until start opens it for reading.
+func waitExecFifo(fifofd int) {
+	slog.Debug("Child waiting on the exec fifo", "fd", fifofd)
+	fd, err := Open("/proc/self/fd/"+strconv.Itoa(fifofd), syscall.O_WRONLY|syscall.O_CLOEXEC)
+	if err != 0 {
+		log.Fatal("Error opening the exec fifo: ", err)
+	}
+	_, err = Write(fd, []byte("0"))
 	if err != 0 {
-		log.Fatal("Error executing ", args[0], ": ", err)
+		log.Fatal("Error writing to the exec fifo: ", err)
+	}
+	Close(fd)
+	Close(fifofd)
+}
+
+// Untars the image and sets up the container and its state.
+// The container process is described by the image config, overridden by the
+// command line.
+func prepareContainer(args []string, entrypointSet bool) (*Container, *State) {
+	// Untar the container image into a predefined root
+	// For now let's use hardocded paths
+	con, unlock, errc := SetContainer(image, platform, base_path)
+	if errc != nil {
+		log.Fatal("Error trying to setup container ", ": ", errc)
+	}
+	defer unlock()
+	config := con.Image.Config
+	command, errc := ResolveCommand(config, entrypoint, entrypointSet, args)
+	if errc != nil {
+		log.Fatal(errc)
+	}
+	state := NewState(con, con.ImageRef.String(), command)
+	state.Env = ResolveEnv(config.Env, envVariables)
+	state.Cwd = config.WorkingDir
+	if len(workdir) != 0 {
+		state.Cwd = workdir
+	}
+	state.User = config.User
+	if len(user) != 0 {
+		state.User = user
+	}
+	state.Init = useInit
+	state.AutoRemove = autoRemove
+	if errs := state.Save(); errs != nil {
+		log.Fatal("Error saving the state of the container ", con.id, ": ", errs)
 	}
-	// Clean up everything before returning
-	defer func() {
-		er := os.RemoveAll(con.Path)
-		if er != nil {
-			log.Println("Error removing ", con.Path)
+	return con, state
+}
+
+// Relays the signals received by rocked to the container process, from a
+// goroutine.
+// Once the container is asked to terminate (SIGINT or SIGTERM), it gets
+// killed if it's still around after timeout (a negative timeout disables this).
+// It returns a function stopping the relay, after which nothing is sent to
+// the process anymore and pidfd can be closed.
+func forwardSignals(signals chan os.Signal, pid, pidfd int, timeout time.Duration) func() {
+	send := func(sig syscall.Signal) {
+		var err syscall.Errno
+		if pidfd >= 0 {
+			err = PidfdSendSignal(pidfd, sig)
+		} else {
+			err = Kill(pid, sig)
+		}
+		if err != 0 && err != syscall.ESRCH {
+			log.Printf("Error sending %v to %v: %v", sig, pid, err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var killTimer *time.Timer
+		var kill <-chan time.Time
+		defer func() {
+			if killTimer != nil {
+				killTimer.Stop()
+			}
+		}()
+		for {
+			select {
+			case s, ok := <-signals:
+				if !ok {
+					return
+				}
+				sig := s.(syscall.Signal)
+				slog.Debug("Forwarding signal", "signal", sig, "pid", pid)
+				send(sig)
+				if (sig == syscall.SIGINT || sig == syscall.SIGTERM) && killTimer == nil && timeout >= 0 {
+					killTimer = time.NewTimer(timeout)
+					kill = killTimer.C
+				}
+			case <-kill:
+				log.Printf("%v did not stop after %v, killing it", pid, timeout)
+				send(syscall.SIGKILL)
+				kill = nil
+			}
 		}
 	}()
-	return 0, 0
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+		<-done
+	}
 }
 
-func run(args []string) {
+func run(args []string, entrypointSet bool) {
 	ppid := os.Getpid()
 	slog.Debug("Forking", "pid thread", ppid, "user", os.Getuid())
-	if len(args) == 0 {
-		fmt.Printf("You need to specify a program to run\n")
+	if detach && (tty || interactive) {
+		log.Fatal("A detached container can't be attached to the terminal")
+	}
+	con, state := prepareContainer(args, entrypointSet)
+	if detach {
+		id, errs := startShim(con, false)
+		if errs != nil {
+			log.Fatal("Error starting the container ", con.id, ": ", errs)
+		}
+		fmt.Println(id)
 		return
 	}
-	childpid, err := runFork(base_path, image, args)
+	opts := forkOptions{interactive: interactive}
+	var term *Terminal
+	if tty {
+		var errt error
+		term, errt = NewTerminal()
+		if errt != nil {
+			log.Fatal("Error allocating a terminal: ", errt)
+		}
+		opts.ttySlave = term.Slave
+	}
+	// Catch the signals before the fork, the ones received meanwhile are queued
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals, RUN_FORWARDED_SIGNALS...)
+	childpid, pidfd, err := runFork(con, state, opts)
 	if err != 0 {
-		log.Printf("There was an error while forking: %v", err)
+		state.SetStopped(-1)
+		cleanupStopped(state)
+		log.Fatalf("There was an error while forking: %v", err)
+	}
+	if term != nil {
+		term.Proxy(interactive)
 	}
+	if errs := state.SetRunning(childpid); errs != nil {
+		log.Printf("Error saving the state of the container %v: %v", con.id, errs)
+	}
+	stopForwarding := forwardSignals(signals, childpid, pidfd, time.Duration(stopTimeout)*time.Second)
 	// Wait
-	Wait(childpid)
-	log.Printf("%v exited\n", childpid)
-	return
+	ws, err := Wait(childpid)
+	if err != 0 {
+		log.Fatalf("Error waiting for %v: %v", childpid, err)
+	}
+	stopForwarding()
+	if pidfd >= 0 {
+		Close(pidfd)
+	}
+	if term != nil {
+		term.Close()
+	}
+	log.Printf("%v %v\n", childpid, ws)
+	if errs := state.SetStopped(ws.ExitStatus()); errs != nil {
+		log.Printf("Error saving the state of the container %v: %v", con.id, errs)
+	}
+	cleanupStopped(state)
+	// Exit with the container exit status, so rocked can be used in scripts
+	os.Exit(ws.ExitStatus())
 }
 
 // runCmd represents the run command
@@ -226,13 +488,16 @@ var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Runs a process",
 	Run: func(cmd *cobra.Command, args []string) {
-		run(args)
+		run(args, cmd.Flags().Changed("entrypoint"))
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(runCmd)
-	runCmd.Flags().StringArrayVarP(&envVariables, "env", "e", nil, "Sets environment variables. It can be repeated")
-	runCmd.Flags().StringVarP(&image, "image", "i", "Fedora", "Use the container image")
-	runCmd.MarkFlagRequired("image")
+	addProcessFlags(runCmd)
+	runCmd.Flags().BoolVar(&autoRemove, "rm", false, "Remove the container once it stops")
+	runCmd.Flags().BoolVarP(&detach, "detach", "d", false, "Run the container in background and print its id")
+	runCmd.Flags().BoolVarP(&tty, "tty", "t", false, "Allocate a pseudo-terminal for the container")
+	runCmd.Flags().BoolVarP(&interactive, "interactive", "I", false, "Keep the standard input open")
+	runCmd.Flags().IntVar(&stopTimeout, "stop-timeout", 10, "Seconds to wait for the container to stop after SIGINT or SIGTERM before killing it (-1 to wait forever)")
 }
@@ -0,0 +1,157 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	STDOUT_LOG = "stdout.log"
+	STDERR_LOG = "stderr.log"
+	// The shim reports back to the process which started it on this file descriptor.
+	SHIM_SYNC_FD = 3
+	EXEC_FIFO    = "exec.fifo"
+	shimCreate   bool
+)
+
+// startShim starts a detached supervisor for the container.
+// The shim is the rocked binary itself, re-executed with the hidden shim command,
+// in its own session and with the standard output and error redirected to the
+// log files in the container directory.
+// It returns once the container process has been created.
+// If create is true, the container process waits to be started (see start).
+func startShim(con *Container, create bool) (string, error) {
+	slog.Debug("startShim", "id", con.id, "path", con.Path, "create", create)
+	stdout, err := os.OpenFile(con.Path+"/"+STDOUT_LOG, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return "", err
+	}
+	defer stdout.Close()
+	stderr, err := os.OpenFile(con.Path+"/"+STDERR_LOG, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return "", err
+	}
+	defer stderr.Close()
+	syncr, syncw, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer syncr.Close()
+
+	args := []string{"shim", con.id}
+	if Verbose {
+		args = append(args, "--verbose")
+	}
+	if create {
+		err = syscall.Mkfifo(con.Path+"/"+EXEC_FIFO, 0600)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--create")
+	}
+	shim := exec.Command("/proc/self/exe", args...)
+	shim.Stdout = stdout
+	shim.Stderr = stderr
+	shim.ExtraFiles = []*os.File{syncw}
+	shim.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = shim.Start()
+	syncw.Close()
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("startShim", "id", con.id, "shim pid", shim.Process.Pid)
+	// The shim must not become a zombie of ours
+	shim.Process.Release()
+
+	msg, err := io.ReadAll(syncr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.Atoi(string(msg)); err != nil {
+		return "", fmt.Errorf("the container did not start, see %v", con.Path+"/"+STDERR_LOG)
+	}
+	return con.id, nil
+}
+
+// shim supervises a single container: it creates the container process,
+// waits for it and records its exit in the container state.
+// If create is true, the container process is left waiting on the exec fifo.
+func shim(id string, create bool) {
+	slog.Debug("shim", "id", id, "pid", os.Getpid())
+	// The sync pipe must not leak into the container process
+	syscall.CloseOnExec(SHIM_SYNC_FD)
+	sync := os.NewFile(uintptr(SHIM_SYNC_FD), "sync")
+	con, err := LoadContainer(base_path, id)
+	if err != nil {
+		log.Fatal("Error loading the container: ", err)
+	}
+	state, err := LoadState(con.Path)
+	if err != nil {
+		log.Fatal("Error loading the state of the container ", id, ": ", err)
+	}
+	opts := forkOptions{}
+	if create {
+		opts.execFifo = con.Path + "/" + EXEC_FIFO
+	}
+	childpid, pidfd, errno := runFork(con, state, opts)
+	if pidfd >= 0 {
+		Close(pidfd)
+	}
+	if errno != 0 {
+		log.Printf("There was an error while forking: %v", errno)
+		state.SetStopped(-1)
+		cleanupStopped(state)
+		os.Exit(1)
+	}
+	if create {
+		err = state.SetCreated(childpid)
+	} else {
+		err = state.SetRunning(childpid)
+	}
+	if err != nil {
+		log.Printf("Error saving the state of the container %v: %v", id, err)
+	}
+	fmt.Fprintf(sync, "%d", childpid)
+	sync.Close()
+
+	ws, errno := Wait(childpid)
+	if errno != 0 {
+		log.Printf("Error waiting for %v: %v", childpid, errno)
+		state.SetStopped(-1)
+		cleanupStopped(state)
+		os.Exit(1)
+	}
+	log.Printf("%v %v\n", childpid, ws)
+	if err := state.SetStopped(ws.ExitStatus()); err != nil {
+		log.Printf("Error saving the state of the container %v: %v", id, err)
+	}
+	cleanupStopped(state)
+}
+
+// shimCmd represents the internal shim command, started by run --detach
+var shimCmd = &cobra.Command{
+	Use:    "shim <id>",
+	Short:  "Supervises a detached container",
+	Hidden: true,
+	Args:   cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		shim(args[0], shimCreate)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(shimCmd)
+	shimCmd.Flags().BoolVar(&shimCreate, "create", false, "Leave the container process waiting to be started")
+}
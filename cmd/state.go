@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rocked/utils"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"log/slog"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Container status values, named after the OCI runtime spec states.
+const (
+	StatusCreated = "created"
+	StatusRunning = "running"
+	StatusStopped = "stopped"
+)
+
+var (
+	STATE_FILE      = "state.json"
+	STATE_LOCK_FILE = "state.lock"
+)
+
+// State is the persistent record of a container, stored as state.json
+// in the container directory.
+type State struct {
+	Id    string `json:"id"`
+	Image string `json:"image"`
+	// The digest of the image entry of the store index, not of its manifest
+	ImageDigest digest.Digest `json:"imageDigest,omitempty"`
+	Layers      []string      `json:"layers,omitempty"` // The image layers, from the bottom-most to the top-most
+	Command     []string      `json:"command"`
+	Env         []string      `json:"env,omitempty"`
+	Cwd         string        `json:"cwd,omitempty"`
+	User        string        `json:"user,omitempty"`
+	Init        bool          `json:"init,omitempty"`
+	AutoRemove  bool          `json:"autoRemove,omitempty"` // Remove the container once it stops
+	Pid         int           `json:"pid"`
+	Status      string        `json:"status"`
+	ExitCode    int           `json:"exitCode"`
+	Bundle      string        `json:"bundle"`
+	Created     time.Time     `json:"created"`
+	Started     *time.Time    `json:"started,omitempty"`
+	Finished    *time.Time    `json:"finished,omitempty"`
+}
+
+func NewState(con *Container, image string, args []string) *State {
+	slog.Debug("State: Initialising new state", "id", con.id, "image", image, "args", args)
+	return &State{
+		Id:          con.id,
+		Image:       image,
+		ImageDigest: con.ImageDigest,
+		Layers:      con.Layers,
+		Command:     args,
+		Status:      StatusCreated,
+		Bundle:      con.Path,
+		Created:     time.Now(),
+	}
+}
+
+// Path returns the location of the state file.
+func (s *State) Path() string {
+	return filepath.Join(s.Bundle, STATE_FILE)
+}
+
+// Save writes the state file.
+// The content is written to a temporary file first and then renamed, so readers
+// never see a partially written state.
+func (s *State) Save() error {
+	slog.Debug("State: Save", "id", s.Id, "status", s.Status, "pid", s.Pid)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.Path() + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path())
+}
+
+// update applies fn to the state while holding the state lock.
+// The state is re-read from disk first, so changes made by other rocked
+// processes (e.g. start and the shim) are not lost.
+func (s *State) update(fn func(*State)) error {
+	lock, err := os.OpenFile(filepath.Join(s.Bundle, STATE_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	current, err := LoadState(s.Bundle)
+	if err == nil {
+		*s = *current
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	fn(s)
+	return s.Save()
+}
+
+// Marks the container as created, with its process waiting to be started
+func (s *State) SetCreated(pid int) error {
+	return s.update(func(s *State) {
+		s.Pid = pid
+		s.Status = StatusCreated
+	})
+}
+
+// Marks the container as running with the given pid
+func (s *State) SetRunning(pid int) error {
+	return s.update(func(s *State) {
+		now := time.Now()
+		s.Pid = pid
+		s.Status = StatusRunning
+		s.Started = &now
+	})
+}
+
+// Marks a created container as running.
+// It does nothing if the container is not in the created state anymore
+// (e.g. it was killed before being started).
+func (s *State) SetStarted() error {
+	return s.update(func(s *State) {
+		if s.Status != StatusCreated {
+			return
+		}
+		now := time.Now()
+		s.Status = StatusRunning
+		s.Started = &now
+	})
+}
+
+// Marks the container as stopped with the given exit code
+func (s *State) SetStopped(exitCode int) error {
+	return s.update(func(s *State) {
+		now := time.Now()
+		s.Status = StatusStopped
+		s.ExitCode = exitCode
+		s.Finished = &now
+	})
+}
+
+// Checks that the process recorded in the state is still alive.
+// A running container whose process is gone (e.g. rocked was killed before
+// it could record the exit) is reported as stopped.
+func (s *State) Refresh() {
+	if (s.Status != StatusRunning && s.Status != StatusCreated) || s.Pid <= 0 {
+		return
+	}
+	if err := Kill(s.Pid, 0); err == syscall.ESRCH {
+		slog.Debug("State: Refresh process is gone", "id", s.Id, "pid", s.Pid)
+		s.Status = StatusStopped
+		s.ExitCode = -1
+	}
+}
+
+// LoadState reads the state file from the container directory path.
+func LoadState(path string) (*State, error) {
+	slog.Debug("State: LoadState", "path", path)
+	data, err := os.ReadFile(filepath.Join(path, STATE_FILE))
+	if err != nil {
+		return nil, err
+	}
+	var s State
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListStates returns the states of all the containers found in basePath,
+// sorted from the newest to the oldest.
+// Directories without a state file are skipped.
+func ListStates(basePath string) ([]*State, error) {
+	slog.Debug("State: ListStates", "basePath", basePath)
+	entries, err := os.ReadDir(basePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var states []*State
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		s, err := LoadState(filepath.Join(basePath, entry.Name()))
+		if err != nil {
+			slog.Debug("State: ListStates skipping", "dir", entry.Name(), "err", err)
+			continue
+		}
+		s.Refresh()
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Created.After(states[j].Created)
+	})
+	return states, nil
+}
+
+// ResolveContainerId returns the id of the container in basePath matching
+// the given id or unique id prefix.
+func ResolveContainerId(basePath, prefix string) (string, error) {
+	slog.Debug("State: ResolveContainerId", "basePath", basePath, "prefix", prefix)
+	if len(prefix) == 0 {
+		return "", fmt.Errorf("empty container id")
+	}
+	entries, err := os.ReadDir(basePath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	var found []string
+	for _, entry := range entries {
+		if !entry.IsDir() || !utils.PathExists(filepath.Join(basePath, entry.Name(), STATE_FILE)) {
+			continue
+		}
+		if entry.Name() == prefix {
+			return prefix, nil
+		}
+		if strings.HasPrefix(entry.Name(), prefix) {
+			found = append(found, entry.Name())
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("container %v not found", prefix)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("container id %v is ambiguous", prefix)
+	}
+}
@@ -0,0 +1,92 @@
+package cmd_test
+
+import (
+	"os"
+	"rocked/cmd"
+	"testing"
+)
+
+func TestStateSaveLoad(t *testing.T) {
+	con := cmd.NewContainer(t.TempDir() + "/")
+	if err := os.MkdirAll(con.Path, 0770); err != nil {
+		t.Fatalf("Could not create the container directory (%v)", err)
+	}
+	state := cmd.NewState(con, "Fedora", []string{"/usr/bin/true"})
+	if err := state.SetRunning(1234); err != nil {
+		t.Fatalf("SetRunning returned an error (%v)", err)
+	}
+	got, err := cmd.LoadState(con.Path)
+	if err != nil {
+		t.Fatalf("LoadState returned an error (%v)", err)
+	}
+	if got.Id != state.Id || got.Pid != 1234 || got.Status != cmd.StatusRunning || got.Started == nil {
+		t.Errorf("got %+v want %+v", got, state)
+	}
+	if err := state.SetStopped(3); err != nil {
+		t.Fatalf("SetStopped returned an error (%v)", err)
+	}
+	got, _ = cmd.LoadState(con.Path)
+	if got.Status != cmd.StatusStopped || got.ExitCode != 3 || got.Finished == nil {
+		t.Errorf("got %+v want status %v exit code 3", got, cmd.StatusStopped)
+	}
+}
+
+func TestListStates(t *testing.T) {
+	base := t.TempDir() + "/"
+	for _, image := range []string{"Fedora", "Ubuntu"} {
+		con := cmd.NewContainer(base)
+		os.MkdirAll(con.Path, 0770)
+		if err := cmd.NewState(con, image, []string{"/bin/sh"}).Save(); err != nil {
+			t.Fatalf("Save returned an error (%v)", err)
+		}
+	}
+	// Directories without a state must be ignored
+	os.MkdirAll(base+"not-a-container", 0770)
+	states, err := cmd.ListStates(base)
+	if err != nil {
+		t.Fatalf("ListStates returned an error (%v)", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("got %v states want 2", len(states))
+	}
+	if states[0].Image != "Ubuntu" {
+		t.Errorf("got %v want the newest container first", states[0].Image)
+	}
+}
+
+func TestListStatesMissingDir(t *testing.T) {
+	states, err := cmd.ListStates("/tmp/rocked-does-not-exist/")
+	if err != nil || len(states) != 0 {
+		t.Fatalf("got %v, %v want no states and no error", states, err)
+	}
+}
+
+func TestResolveContainerId(t *testing.T) {
+	base := t.TempDir() + "/"
+	for _, id := range []string{"6e220a98-c915", "6e221b00-aaaa", "7f000000-bbbb"} {
+		os.MkdirAll(base+id, 0770)
+		os.WriteFile(base+id+"/"+cmd.STATE_FILE, []byte("{}"), 0644)
+	}
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{"6e220a98-c915", "6e220a98-c915", false},
+		{"7f", "7f000000-bbbb", false},
+		{"6e22", "", true},
+		{"8", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got, err := cmd.ResolveContainerId(base, tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
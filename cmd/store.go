@@ -0,0 +1,886 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"rocked/specs"
+	"rocked/specs/layout"
+	"rocked/utils"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"log/slog"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	IMAGE_STORE_PATH = "/var/lib/rocked/images"
+	// Directory of the store holding the unpacked layers, by diff ID
+	STORE_LAYERS_DIR = "layers"
+	STORE_LOCK_FILE  = "store.lock"
+	// Lock held shared while blobs are added before being tagged, and
+	// exclusive by the garbage collection
+	STORE_GC_LOCK_FILE = "gc.lock"
+	// How often the unpacking progress is reported
+	PROGRESS_INTERVAL = time.Second
+	// How many times the fetch of a blob is retried, resuming it
+	BLOB_FETCH_RETRIES = 3
+	// The prefix of the blobs being fetched, in the blobs directory
+	PARTIAL_BLOB_PREFIX = ".partial-"
+)
+
+// ErrImageNotFound is returned when an image is not in the store
+var ErrImageNotFound = errors.New("image not found")
+
+// ImageStore is the local image store.
+// It is an OCI image layout (oci-layout, index.json and the blobs by digest),
+// plus the layers unpacked once and shared by all the containers.
+// The index manifests are named with the org.opencontainers.image.ref.name
+// annotation.
+type ImageStore struct {
+	Path string
+	// If set, the layer unpacking progress is written to it
+	Progress io.Writer
+}
+
+func NewImageStore(path string) *ImageStore {
+	slog.Debug("ImageStore: Initialising", "path", path)
+	return &ImageStore{Path: path}
+}
+
+// Creates the store layout, if missing
+func (s *ImageStore) Init() error {
+	if _, err := layout.Create(s.Path); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(s.Path, STORE_LAYERS_DIR), 0755)
+}
+
+// Returns the OCI image layout of the store
+func (s *ImageStore) layout() *layout.Layout {
+	return &layout.Layout{Path: s.Path}
+}
+
+// Takes the store lock, released by the returned function.
+// The index updates and the layer unpacking are serialised through it.
+func (s *ImageStore) lock() (func(), error) {
+	return s.flock(STORE_LOCK_FILE, syscall.LOCK_EX)
+}
+
+// Takes the garbage collection lock shared, released by the returned
+// function.
+// It's held while the blobs of an image are added, until the image is
+// tagged, while the layers of a container are unpacked, until its state
+// records them, and while an image is pushed, so that GarbageCollect, which
+// takes it exclusive, doesn't remove them in between.
+// When both are needed, it's taken before the store lock.
+func (s *ImageStore) lockBlobs() (func(), error) {
+	return s.flock(STORE_GC_LOCK_FILE, syscall.LOCK_SH)
+}
+
+// Takes the lock file name of the store, shared or exclusive as how
+func (s *ImageStore) flock(name string, how int) (func(), error) {
+	lock, err := os.OpenFile(filepath.Join(s.Path, name), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}, nil
+}
+
+// BlobPath returns the location of the blob with digest d
+func (s *ImageStore) BlobPath(d digest.Digest) string {
+	return s.layout().BlobPath(d)
+}
+
+// LayerPath returns the location of the layer unpacked from the blob with diff ID d
+func (s *ImageStore) LayerPath(d digest.Digest) string {
+	return filepath.Join(s.Path, STORE_LAYERS_DIR, d.Algorithm().String(), d.Encoded())
+}
+
+func (s *ImageStore) HasBlob(d digest.Digest) bool {
+	return s.layout().HasBlob(d)
+}
+
+// WriteBlob stores the content of r as the blob with digest d.
+// The content is verified before being moved in place, so the store never
+// holds a blob not matching its digest.
+func (s *ImageStore) WriteBlob(r io.Reader, d digest.Digest) error {
+	slog.Debug("ImageStore: WriteBlob", "digest", d)
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if !IsValidAlgorithm(d.Algorithm().String()) {
+		return &AlgorithmError{}
+	}
+	err := s.layout().WriteBlob(r, d)
+	var mismatch *layout.DigestError
+	if errors.As(err, &mismatch) {
+		return &BlobVerificationError{Digest: d, Reason: "content does not match the digest"}
+	}
+	return err
+}
+
+// BlobFetcher returns the content of a blob from offset, and the offset the
+// content actually starts at (e.g. 0 if the source can't resume)
+type BlobFetcher func(offset int64) (io.ReadCloser, int64, error)
+
+// IngestBlob stores the blob described by desc, fetched with fetch.
+// The content is appended to a partial blob, kept if the fetch fails, so a
+// later IngestBlob resumes where it stopped. A failed fetch is retried
+// BLOB_FETCH_RETRIES times.
+// The blob is verified against desc before being moved in place.
+// If set, onProgress is called with the bytes fetched so far.
+func (s *ImageStore) IngestBlob(desc specs.Descriptor, fetch BlobFetcher, onProgress func(int64, bool)) error {
+	slog.Debug("ImageStore: IngestBlob", "blob", desc.Digest, "size", desc.Size)
+	d := desc.Digest
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if !IsValidAlgorithm(d.Algorithm().String()) {
+		return &AlgorithmError{}
+	}
+	if s.HasBlob(d) {
+		return nil
+	}
+	path := s.BlobPath(d)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	partial := filepath.Join(filepath.Dir(path), PARTIAL_BLOB_PREFIX+d.Encoded())
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Someone else fetching the same blob goes first
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	if s.HasBlob(d) {
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		offset, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if desc.Size > 0 && offset >= desc.Size {
+			break
+		}
+		err = s.fetchBlobFrom(f, desc, offset, fetch, onProgress)
+		if err == nil {
+			break
+		}
+		if attempt == BLOB_FETCH_RETRIES {
+			return err
+		}
+		slog.Debug("ImageStore: IngestBlob retrying", "blob", d, "attempt", attempt, "error", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := &verifyingReader{file: f, desc: desc, verifier: d.Verifier()}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// Appends to f the content of the blob desc fetched from offset
+func (s *ImageStore) fetchBlobFrom(f *os.File, desc specs.Descriptor, offset int64, fetch BlobFetcher, onProgress func(int64, bool)) error {
+	body, start, err := fetch(offset)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if start != offset {
+		slog.Debug("ImageStore: IngestBlob restarting", "blob", desc.Digest, "offset", offset, "start", start)
+		if err := f.Truncate(start); err != nil {
+			return err
+		}
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	var r io.Reader = body
+	// Never more than a byte over the size, enough to tell the blob is wrong
+	if desc.Size > 0 {
+		r = io.LimitReader(body, desc.Size-start+1)
+	}
+	if onProgress != nil {
+		r = &utils.ProgressReader{
+			Reader:   r,
+			Interval: PROGRESS_INTERVAL,
+			OnProgress: func(read int64, done bool) {
+				onProgress(start+read, done)
+			},
+		}
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// Stores the content of f, from its start, as a blob, returning its descriptor
+func (s *ImageStore) addBlob(f io.ReadSeeker, mediaType string) (specs.Descriptor, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return specs.Descriptor{}, err
+	}
+	d, err := digest.FromReader(f)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return specs.Descriptor{}, err
+	}
+	if err := s.WriteBlob(f, d); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return specs.Descriptor{MediaType: mediaType, Digest: d, Size: size}, nil
+}
+
+// Writes v as a canonical JSON blob, returning its descriptor
+func (s *ImageStore) writeJSONBlob(mediaType string, v any) (specs.Descriptor, error) {
+	return s.layout().WriteJSONBlob(mediaType, v)
+}
+
+// Reads the blob described by desc, verifying it, and decodes it as JSON into v
+func (s *ImageStore) readJSONBlob(desc specs.Descriptor, v any) error {
+	r, err := s.OpenBlob(desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *ImageStore) ReadManifest(desc specs.Descriptor) (specs.Manifest, error) {
+	slog.Debug("ImageStore: ReadManifest", "manifest", desc.Digest)
+	var manifest specs.Manifest
+	if !specs.IsImageManifest(desc.MediaType) {
+		return manifest, &MediaTypeError{}
+	}
+	err := s.readJSONBlob(desc, &manifest)
+	return manifest, err
+}
+
+func (s *ImageStore) ReadConfig(desc specs.Descriptor) (specs.Image, error) {
+	slog.Debug("ImageStore: ReadConfig", "config", desc.Digest)
+	var config specs.Image
+	if !specs.IsImageConfig(desc.MediaType) {
+		return config, &MediaTypeError{}
+	}
+	err := s.readJSONBlob(desc, &config)
+	return config, err
+}
+
+func (s *ImageStore) ReadIndex() (specs.Index, error) {
+	return s.layout().ReadIndex()
+}
+
+// Applies fn to the index while holding the store lock
+func (s *ImageStore) updateIndex(fn func(*specs.Index) error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	index, err := s.ReadIndex()
+	if err != nil {
+		return err
+	}
+	if err := fn(&index); err != nil {
+		return err
+	}
+	return s.layout().WriteIndex(index)
+}
+
+// Tag adds the manifest desc to the index with the name ref, in its
+// canonical form (e.g. fedora:latest for fedora).
+// A manifest previously named ref loses the name.
+// With an empty ref, the manifest is added without a name, unless it's
+// already in the index.
+func (s *ImageStore) Tag(desc specs.Descriptor, ref string) error {
+	slog.Debug("ImageStore: Tag", "manifest", desc.Digest, "ref", ref)
+	if len(ref) != 0 {
+		parsed, err := ParseReference(ref)
+		if err != nil {
+			return err
+		}
+		if len(parsed.Digest) != 0 {
+			return fmt.Errorf("can't name an image with a digest reference %v", ref)
+		}
+		ref = parsed.String()
+	}
+	return s.updateIndex(func(index *specs.Index) error {
+		layout.AddManifest(index, desc, ref)
+		return nil
+	})
+}
+
+// Resolve returns the descriptor of the manifest matching ref: the one with
+// the ref digest if it has one, otherwise the one named by the reference.
+func (s *ImageStore) Resolve(ref Reference) (specs.Descriptor, error) {
+	slog.Debug("ImageStore: Resolve", "ref", ref)
+	index, err := s.ReadIndex()
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	names := ref.refNames()
+	var byDigest *specs.Descriptor
+	for i, m := range index.Manifests {
+		named := slices.Contains(names, m.Annotations[specs.AnnotationRefName])
+		if len(ref.Digest) == 0 {
+			if named {
+				return m, nil
+			}
+			continue
+		}
+		if m.Digest != ref.Digest {
+			continue
+		}
+		// Prefer the entry with the given name, if any
+		if named || len(names) == 0 {
+			return m, nil
+		}
+		if byDigest == nil {
+			byDigest = &index.Manifests[i]
+		}
+	}
+	if byDigest != nil {
+		return *byDigest, nil
+	}
+	return specs.Descriptor{}, fmt.Errorf("%w: %v", ErrImageNotFound, ref)
+}
+
+// Returns the platform of a manifest, from its descriptor or its config
+func (s *ImageStore) manifestPlatform(desc specs.Descriptor) (specs.Platform, error) {
+	if desc.Platform != nil {
+		return *desc.Platform, nil
+	}
+	manifest, err := s.ReadManifest(desc)
+	if err != nil {
+		return specs.Platform{}, err
+	}
+	config, err := s.ReadConfig(manifest.Config)
+	if err != nil {
+		return specs.Platform{}, err
+	}
+	return config.Platform, nil
+}
+
+// ResolveManifest returns the image manifest of desc for the platform want.
+// An image index, and the indexes nested in it, are walked to find the
+// manifest best matching the platform.
+func (s *ImageStore) ResolveManifest(desc specs.Descriptor, want specs.Platform) (specs.Descriptor, error) {
+	slog.Debug("ImageStore: ResolveManifest", "desc", desc.Digest, "mediaType", desc.MediaType, "platform", PlatformString(want))
+	switch {
+	case specs.IsImageManifest(desc.MediaType):
+		p, err := s.manifestPlatform(desc)
+		if err != nil {
+			return specs.Descriptor{}, err
+		}
+		// An image without a platform is assumed to run anywhere
+		if len(p.OS) != 0 && len(p.Architecture) != 0 && MatchPlatform(want, p) == 0 {
+			return specs.Descriptor{}, &NoMatchingPlatformError{Want: want, Available: []specs.Platform{p}}
+		}
+		return desc, nil
+	case specs.IsImageIndex(desc.MediaType):
+	default:
+		return specs.Descriptor{}, &MediaTypeError{}
+	}
+	var index specs.Index
+	if err := s.readJSONBlob(desc, &index); err != nil {
+		return specs.Descriptor{}, err
+	}
+	noMatch := &NoMatchingPlatformError{Want: want}
+	var best specs.Descriptor
+	bestScore := 0
+	for _, m := range index.Manifests {
+		if specs.IsImageIndex(m.MediaType) {
+			nested, err := s.ResolveManifest(m, want)
+			var e *NoMatchingPlatformError
+			if errors.As(err, &e) {
+				noMatch.Available = append(noMatch.Available, e.Available...)
+			}
+			if err != nil {
+				slog.Debug("ImageStore: ResolveManifest nested index", "index", m.Digest, "error", err)
+				continue
+			}
+			m = nested
+		}
+		if !specs.IsImageManifest(m.MediaType) {
+			continue
+		}
+		// e.g. pulled or loaded for another platform
+		if !s.HasBlob(m.Digest) {
+			slog.Debug("ImageStore: ResolveManifest missing manifest", "manifest", m.Digest)
+			continue
+		}
+		p, err := s.manifestPlatform(m)
+		if err != nil {
+			slog.Debug("ImageStore: ResolveManifest", "manifest", m.Digest, "error", err)
+			continue
+		}
+		noMatch.Available = append(noMatch.Available, p)
+		if score := MatchPlatform(want, p); score > bestScore {
+			best = m
+			bestScore = score
+		}
+	}
+	if bestScore == 0 {
+		return specs.Descriptor{}, noMatch
+	}
+	return best, nil
+}
+
+// Lookup parses the image reference ref and resolves it
+func (s *ImageStore) Lookup(ref string) (specs.Descriptor, error) {
+	parsed, err := ParseReference(ref)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	return s.Resolve(parsed)
+}
+
+// ImportLayout copies the images of the OCI image layout in dir into the store.
+// The manifests and image indexes are tagged with their ref name annotation
+// or, if they don't have one, with name.
+// The manifests of an image index missing from the layout (e.g. copied for a
+// single platform) are skipped.
+// It returns the descriptors of the imported manifests and indexes.
+func (s *ImageStore) ImportLayout(dir, name string) ([]specs.Descriptor, error) {
+	slog.Debug("ImageStore: ImportLayout", "dir", dir, "name", name)
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	src := &layout.Layout{Path: dir}
+	index, err := src.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	copyBlob := func(d digest.Digest) error {
+		f, err := os.Open(src.BlobPath(d))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return s.WriteBlob(f, d)
+	}
+	var importDesc func(desc specs.Descriptor) error
+	importDesc = func(desc specs.Descriptor) error {
+		if err := copyBlob(desc.Digest); err != nil {
+			return err
+		}
+		if specs.IsImageIndex(desc.MediaType) {
+			var nested specs.Index
+			if err := s.readJSONBlob(desc, &nested); err != nil {
+				return err
+			}
+			for _, m := range nested.Manifests {
+				if !src.HasBlob(m.Digest) {
+					slog.Debug("ImageStore: ImportLayout missing manifest", "manifest", m.Digest, "platform", m.Platform)
+					continue
+				}
+				if err := importDesc(m); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if !specs.IsImageManifest(desc.MediaType) {
+			// e.g. an artifact, its blobs are copied only if they're in the layout
+			return nil
+		}
+		manifest, err := s.ReadManifest(desc)
+		if err != nil {
+			return err
+		}
+		for _, blob := range append([]specs.Descriptor{manifest.Config}, manifest.Layers...) {
+			if err := copyBlob(blob.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var imported []specs.Descriptor
+	for _, desc := range index.Manifests {
+		if !specs.IsImageManifest(desc.MediaType) && !specs.IsImageIndex(desc.MediaType) {
+			slog.Debug("ImageStore: ImportLayout skipping", "manifest", desc.Digest, "mediaType", desc.MediaType)
+			continue
+		}
+		if err := importDesc(desc); err != nil {
+			return nil, err
+		}
+		ref := desc.Annotations[specs.AnnotationRefName]
+		if len(ref) == 0 {
+			ref = name
+		}
+		if err := s.Tag(desc, ref); err != nil {
+			return nil, err
+		}
+		imported = append(imported, desc)
+	}
+	if len(imported) == 0 {
+		return nil, fmt.Errorf("no image manifest found in %v", dir)
+	}
+	return imported, nil
+}
+
+// Unpack unpacks the layers of an image, if they aren't already.
+// Every layer is unpacked once, in a directory named after its diff ID (the
+// digest of its uncompressed content) shared by all the images using it,
+// whatever the compression of their layer blob.
+// It returns the layer directories, from the bottom-most to the top-most.
+func (s *ImageStore) Unpack(manifest specs.Manifest, config specs.Image) ([]string, error) {
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("the image has %v layers but %v diff IDs", len(manifest.Layers), len(diffIDs))
+	}
+	var layers []string
+	for i, layer := range manifest.Layers {
+		if err := diffIDs[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid diff ID %q: %w", diffIDs[i], err)
+		}
+		path := s.LayerPath(diffIDs[i])
+		if err := s.unpackLayer(layer, diffIDs[i], path); err != nil {
+			return nil, fmt.Errorf("unpacking the layer %v: %w", layer.Digest, err)
+		}
+		layers = append(layers, path)
+	}
+	return layers, nil
+}
+
+// Unpacks the layer blob, whose uncompressed content has the digest diffID,
+// into path.
+// The layer is unpacked in a temporary directory renamed once complete and
+// verified, so a layer directory is always whole and matches its diff ID.
+func (s *ImageStore) unpackLayer(layer specs.Descriptor, diffID digest.Digest, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		slog.Debug("ImageStore: layer already unpacked", "layer", layer.Digest, "path", path)
+		return nil
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Someone else may have unpacked it meanwhile
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	slog.Debug("ImageStore: unpacking", "layer", layer.Digest, "mediaType", layer.MediaType, "path", path)
+	// The extraction reads the blob to its end, so it fails if corrupted
+	blob, err := s.OpenBlob(layer)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	r := &utils.ProgressReader{
+		Reader:     blob,
+		Interval:   PROGRESS_INTERVAL,
+		OnProgress: s.blobProgress(layer, "unpacking", "unpacked"),
+	}
+	// Every layer is its own overlay lower directory
+	if err := utils.ExtractLayer(r, layer.MediaType, tmp, utils.WhiteoutOverlay, diffID); err != nil {
+		// A corrupted blob may fail the extraction before it's verified
+		var verr *BlobVerificationError
+		if _, derr := io.Copy(io.Discard, blob); errors.As(derr, &verr) {
+			return derr
+		}
+		return err
+	}
+	// The layer root gets the permissions of the container root
+	os.Chmod(tmp, 0755)
+	return os.Rename(tmp, path)
+}
+
+// Returns the function reporting the progress of reading blob to s.Progress,
+// e.g. while unpacking it
+func (s *ImageStore) blobProgress(blob specs.Descriptor, doing, done string) func(int64, bool) {
+	if s.Progress == nil {
+		return nil
+	}
+	id := shortId(blob.Digest.Encoded())
+	return func(read int64, finished bool) {
+		if finished {
+			fmt.Fprintf(s.Progress, "%s: %s %s\n", id, done, humanSize(read))
+			return
+		}
+		fmt.Fprintf(s.Progress, "%s: %s %s/%s\n", id, doing, humanSize(read), humanSize(blob.Size))
+	}
+}
+
+// ImageSummary describes an image of the store
+type ImageSummary struct {
+	Name       string        `json:"name"`
+	Repository string        `json:"repository"`
+	Tag        string        `json:"tag"`
+	Digest     digest.Digest `json:"digest"`
+	Created    *time.Time    `json:"created,omitempty"`
+	// The size of the manifest, config and layers blobs
+	Size int64 `json:"size"`
+}
+
+// Splits an image name into its repository and tag
+func splitRepositoryTag(name string) (string, string) {
+	i := strings.LastIndex(name, ":")
+	if i < 0 || strings.Contains(name[i:], "/") {
+		return name, "<none>"
+	}
+	return name[:i], name[i+1:]
+}
+
+// Images returns the summary of the images in the index
+func (s *ImageStore) Images() ([]ImageSummary, error) {
+	index, err := s.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	images := []ImageSummary{}
+	for _, desc := range index.Manifests {
+		summary := ImageSummary{
+			Name:       desc.Annotations[specs.AnnotationRefName],
+			Repository: "<none>",
+			Tag:        "<none>",
+			Digest:     desc.Digest,
+			Size:       desc.Size,
+		}
+		if len(summary.Name) != 0 {
+			summary.Repository, summary.Tag = splitRepositoryTag(summary.Name)
+		}
+		manifestDesc, err := s.ResolveManifest(desc, HostPlatform())
+		if err != nil {
+			manifestDesc = desc
+		} else if manifestDesc.Digest != desc.Digest {
+			summary.Size += manifestDesc.Size
+		}
+		if manifest, err := s.ReadManifest(manifestDesc); err == nil {
+			summary.Size += manifest.Config.Size
+			for _, layer := range manifest.Layers {
+				summary.Size += layer.Size
+			}
+			if config, err := s.ReadConfig(manifest.Config); err == nil {
+				summary.Created = config.Created
+			}
+		} else {
+			slog.Debug("ImageStore: Images", "manifest", desc.Digest, "error", err)
+		}
+		images = append(images, summary)
+	}
+	return images, nil
+}
+
+// Untag removes the manifests named ref from the index.
+// If ref has a digest, all the manifests with that digest are removed.
+func (s *ImageStore) Untag(ref string) error {
+	slog.Debug("ImageStore: Untag", "ref", ref)
+	parsed, err := ParseReference(ref)
+	if err != nil {
+		return err
+	}
+	names := parsed.refNames()
+	return s.updateIndex(func(index *specs.Index) error {
+		manifests := []specs.Descriptor{}
+		for _, m := range index.Manifests {
+			if len(parsed.Digest) != 0 && m.Digest == parsed.Digest {
+				continue
+			}
+			if len(parsed.Digest) == 0 && slices.Contains(names, m.Annotations[specs.AnnotationRefName]) {
+				continue
+			}
+			manifests = append(manifests, m)
+		}
+		if len(manifests) == len(index.Manifests) {
+			return fmt.Errorf("%w: %v", ErrImageNotFound, ref)
+		}
+		index.Manifests = manifests
+		return nil
+	})
+}
+
+// RemoveUnnamed removes the manifests without a name from the index,
+// returning them.
+func (s *ImageStore) RemoveUnnamed() ([]specs.Descriptor, error) {
+	var removed []specs.Descriptor
+	err := s.updateIndex(func(index *specs.Index) error {
+		manifests := []specs.Descriptor{}
+		for _, m := range index.Manifests {
+			if len(m.Annotations[specs.AnnotationRefName]) == 0 {
+				removed = append(removed, m)
+				continue
+			}
+			manifests = append(manifests, m)
+		}
+		index.Manifests = manifests
+		return nil
+	})
+	return removed, err
+}
+
+// Returns the blobs and the layer diff IDs reachable from the index
+// The manifests of an image index missing from the store (e.g. pulled for a
+// single platform) are skipped, but an error is returned if any other index,
+// manifest or config can't be read, as what it references isn't known.
+func (s *ImageStore) reachable(index specs.Index) (map[digest.Digest]bool, map[digest.Digest]bool, error) {
+	blobs := map[digest.Digest]bool{}
+	diffIDs := map[digest.Digest]bool{}
+	var walk func(desc specs.Descriptor) error
+	walk = func(desc specs.Descriptor) error {
+		if blobs[desc.Digest] {
+			return nil
+		}
+		blobs[desc.Digest] = true
+		switch {
+		case specs.IsImageIndex(desc.MediaType):
+			var nested specs.Index
+			if err := s.readJSONBlob(desc, &nested); err != nil {
+				return fmt.Errorf("reading the image index %v: %w", desc.Digest, err)
+			}
+			for _, m := range nested.Manifests {
+				if !s.HasBlob(m.Digest) {
+					slog.Debug("ImageStore: reachable missing manifest", "manifest", m.Digest, "platform", m.Platform)
+					continue
+				}
+				if err := walk(m); err != nil {
+					return err
+				}
+			}
+		case specs.IsImageManifest(desc.MediaType):
+			manifest, err := s.ReadManifest(desc)
+			if err != nil {
+				return fmt.Errorf("reading the manifest %v: %w", desc.Digest, err)
+			}
+			blobs[manifest.Config.Digest] = true
+			for _, layer := range manifest.Layers {
+				blobs[layer.Digest] = true
+			}
+			config, err := s.ReadConfig(manifest.Config)
+			if err != nil {
+				return fmt.Errorf("reading the config %v: %w", manifest.Config.Digest, err)
+			}
+			for _, d := range config.RootFS.DiffIDs {
+				diffIDs[d] = true
+			}
+		}
+		return nil
+	}
+	for _, m := range index.Manifests {
+		if err := walk(m); err != nil {
+			return nil, nil, err
+		}
+	}
+	return blobs, diffIDs, nil
+}
+
+// GarbageCollect removes the blobs and the unpacked layers which are not
+// reachable from the index anymore.
+// The layer directories returned by keep (e.g. used by containers) are never
+// removed: it's called once the pulls, loads and container creations in
+// progress are done, so that their layers are included.
+// Nothing is removed if a document reachable from the index can't be read.
+// It returns the number of blobs and layers removed and the blob bytes freed.
+func (s *ImageStore) GarbageCollect(keep func() ([]string, error)) (int, int64, error) {
+	// Waits for the pulls and loads in progress to tag their images
+	unlockBlobs, err := s.flock(STORE_GC_LOCK_FILE, syscall.LOCK_EX)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlockBlobs()
+	unlock, err := s.lock()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+	index, err := s.ReadIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	blobs, diffIDs, err := s.reachable(index)
+	if err != nil {
+		return 0, 0, err
+	}
+	kept := map[string]bool{}
+	if keep != nil {
+		paths, err := keep()
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, path := range paths {
+			kept[path] = true
+		}
+	}
+	removed := 0
+	var freed int64
+	var errs []error
+	// Walks the entries of dir/<algorithm>/<encoded>, skipping the temporary ones
+	sweep := func(dir string, remove func(d digest.Digest, path string) bool) {
+		algos, _ := os.ReadDir(filepath.Join(s.Path, dir))
+		for _, algo := range algos {
+			entries, _ := os.ReadDir(filepath.Join(s.Path, dir, algo.Name()))
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+				d := digest.NewDigestFromEncoded(digest.Algorithm(algo.Name()), entry.Name())
+				path := filepath.Join(s.Path, dir, algo.Name(), entry.Name())
+				if !remove(d, path) {
+					continue
+				}
+				var size int64
+				if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+					size = info.Size()
+				}
+				slog.Debug("ImageStore: GarbageCollect removing", "path", path)
+				if err := os.RemoveAll(path); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				removed++
+				freed += size
+			}
+		}
+	}
+	sweep(specs.ImageBlobsDir, func(d digest.Digest, path string) bool {
+		return !blobs[d]
+	})
+	sweep(STORE_LAYERS_DIR, func(d digest.Digest, path string) bool {
+		return !diffIDs[d] && !kept[path]
+	})
+	return removed, freed, errors.Join(errs...)
+}
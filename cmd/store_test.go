@@ -0,0 +1,338 @@
+package cmd_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"rocked/cmd"
+	"rocked/specs"
+	"rocked/utils"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Writes data as a blob of the OCI layout in dir and returns its descriptor
+func writeLayoutBlob(t *testing.T, dir, mediaType string, data []byte) specs.Descriptor {
+	d := digest.FromBytes(data)
+	path := filepath.Join(dir, "blobs", d.Algorithm().String(), d.Encoded())
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return specs.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+}
+
+func writeLayoutJSON(t *testing.T, dir, mediaType string, v any) specs.Descriptor {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeLayoutBlob(t, dir, mediaType, data)
+}
+
+// Returns a tar archive with the given files
+func makeTar(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+// Creates an OCI image layout with a single image made of the given layers
+func makeLayout(t *testing.T, ref string, layers ...[]byte) string {
+	var diffIDs []digest.Digest
+	for _, layer := range layers {
+		diffIDs = append(diffIDs, digest.FromBytes(layer))
+	}
+	return makeLayoutDiffIDs(t, ref, specs.MediaTypeImageLayer, layers, diffIDs)
+}
+
+// Creates an OCI image layout with a single image made of the given layer
+// blobs, of type mediaType, and diff IDs
+func makeLayoutDiffIDs(t *testing.T, ref, mediaType string, layers [][]byte, diffIDs []digest.Digest) string {
+	dir := t.TempDir()
+	config := specs.Image{
+		Platform: specs.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   specs.RootFS{Type: "layers"},
+	}
+	manifest := specs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: specs.MediaTypeImageManifest,
+	}
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, writeLayoutBlob(t, dir, mediaType, layer))
+	}
+	config.RootFS.DiffIDs = diffIDs
+	manifest.Config = writeLayoutJSON(t, dir, specs.MediaTypeImageConfig, config)
+	desc := writeLayoutJSON(t, dir, specs.MediaTypeImageManifest, manifest)
+	if len(ref) != 0 {
+		desc.Annotations = map[string]string{specs.AnnotationRefName: ref}
+	}
+	index := specs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: specs.MediaTypeImageIndex,
+		Manifests: []specs.Descriptor{desc},
+	}
+	data, _ := json.Marshal(index)
+	os.WriteFile(filepath.Join(dir, "index.json"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	return dir
+}
+
+func newTestStore(t *testing.T) *cmd.ImageStore {
+	store := cmd.NewImageStore(t.TempDir())
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init returned an error (%v)", err)
+	}
+	return store
+}
+
+func TestImageStoreImportUnpack(t *testing.T) {
+	store := newTestStore(t)
+	base := makeTar(t, map[string]string{"etc/os-release": "base", "bin/sh": "shell"})
+	top := makeTar(t, map[string]string{"etc/os-release": "top"})
+	layout := makeLayout(t, "", base, top)
+
+	imported, err := store.ImportLayout(layout, "test")
+	if err != nil {
+		t.Fatalf("ImportLayout returned an error (%v)", err)
+	}
+	if len(imported) != 1 {
+		t.Fatalf("ImportLayout imported %v manifests, want 1", len(imported))
+	}
+	desc, err := store.Lookup("test")
+	if err != nil {
+		t.Fatalf("Lookup returned an error (%v)", err)
+	}
+	if desc.Digest != imported[0].Digest {
+		t.Fatalf("Lookup returned %v, want %v", desc.Digest, imported[0].Digest)
+	}
+	manifest, err := store.ReadManifest(desc)
+	if err != nil {
+		t.Fatalf("ReadManifest returned an error (%v)", err)
+	}
+	config, err := store.ReadConfig(manifest.Config)
+	if err != nil {
+		t.Fatalf("ReadConfig returned an error (%v)", err)
+	}
+	layers, err := store.Unpack(manifest, config)
+	if err != nil {
+		t.Fatalf("Unpack returned an error (%v)", err)
+	}
+	if len(layers) != 2 || layers[0] != store.LayerPath(config.RootFS.DiffIDs[0]) {
+		t.Fatalf("Unpack returned %v", layers)
+	}
+	for i, want := range []string{"base", "top"} {
+		got, err := os.ReadFile(filepath.Join(layers[i], "etc/os-release"))
+		if err != nil || string(got) != want {
+			t.Fatalf("layer %v: got %q (%v), want %q", i, got, err, want)
+		}
+	}
+	// A second unpack reuses the layers
+	again, err := store.Unpack(manifest, config)
+	if err != nil || strings.Join(again, ":") != strings.Join(layers, ":") {
+		t.Fatalf("second Unpack returned %v (%v), want %v", again, err, layers)
+	}
+}
+
+func TestImageStoreLookupMissing(t *testing.T) {
+	store := newTestStore(t)
+	_, err := store.Lookup("missing")
+	if !errors.Is(err, cmd.ErrImageNotFound) {
+		t.Fatalf("Lookup returned %v, want ErrImageNotFound", err)
+	}
+}
+
+func TestImageStoreTag(t *testing.T) {
+	store := newTestStore(t)
+	layout := makeLayout(t, "v1", makeTar(t, map[string]string{"a": "a"}))
+	imported, err := store.ImportLayout(layout, "ignored")
+	if err != nil {
+		t.Fatalf("ImportLayout returned an error (%v)", err)
+	}
+	if _, err := store.Lookup("v1"); err != nil {
+		t.Fatalf("Lookup of the ref name annotation returned an error (%v)", err)
+	}
+	if err := store.Tag(imported[0], "v1"); err != nil {
+		t.Fatalf("Tag returned an error (%v)", err)
+	}
+	index, _ := store.ReadIndex()
+	if len(index.Manifests) != 1 {
+		t.Fatalf("the index has %v manifests, want 1", len(index.Manifests))
+	}
+}
+
+func TestImageStoreWriteBlobMismatch(t *testing.T) {
+	store := newTestStore(t)
+	d := digest.FromString("expected")
+	if err := store.WriteBlob(strings.NewReader("something else"), d); err == nil {
+		t.Fatalf("WriteBlob accepted a content not matching its digest")
+	}
+	if store.HasBlob(d) {
+		t.Fatalf("the mismatching blob was stored")
+	}
+}
+
+func TestImageStoreImages(t *testing.T) {
+	store := newTestStore(t)
+	layer := makeTar(t, map[string]string{"a": "a"})
+	store.ImportLayout(makeLayout(t, "docker.io/library/fedora:40", layer), "")
+	store.ImportLayout(makeLayout(t, "", layer, makeTar(t, map[string]string{"b": "b"})), "")
+	images, err := store.Images()
+	if err != nil {
+		t.Fatalf("Images returned an error (%v)", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("Images returned %v images, want 2", len(images))
+	}
+	if images[0].Repository != "docker.io/library/fedora" || images[0].Tag != "40" {
+		t.Fatalf("the first image is %v:%v", images[0].Repository, images[0].Tag)
+	}
+	if images[1].Repository != "<none>" || images[1].Tag != "<none>" {
+		t.Fatalf("the unnamed image is %v:%v", images[1].Repository, images[1].Tag)
+	}
+	manifest, _ := store.ReadManifest(specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: images[0].Digest})
+	want := manifest.Config.Size + manifest.Layers[0].Size
+	if images[0].Size <= want {
+		t.Fatalf("the image size is %v, want more than %v", images[0].Size, want)
+	}
+}
+
+func TestImageStoreGarbageCollect(t *testing.T) {
+	store := newTestStore(t)
+	shared := makeTar(t, map[string]string{"shared": "shared"})
+	own := makeTar(t, map[string]string{"own": "own"})
+	store.ImportLayout(makeLayout(t, "keep", shared), "")
+	store.ImportLayout(makeLayout(t, "remove", shared, own), "")
+	for _, ref := range []string{"keep", "remove"} {
+		desc, _ := store.Lookup(ref)
+		manifest, _ := store.ReadManifest(desc)
+		config, _ := store.ReadConfig(manifest.Config)
+		if _, err := store.Unpack(manifest, config); err != nil {
+			t.Fatalf("Unpack returned an error (%v)", err)
+		}
+	}
+	used := store.LayerPath(digest.FromBytes(own))
+
+	if err := store.Untag("remove"); err != nil {
+		t.Fatalf("Untag returned an error (%v)", err)
+	}
+	if err := store.Untag("remove"); !errors.Is(err, cmd.ErrImageNotFound) {
+		t.Fatalf("a second Untag returned %v, want ErrImageNotFound", err)
+	}
+	// The layer is still used by a container
+	removed, _, err := store.GarbageCollect(func() ([]string, error) {
+		return []string{used}, nil
+	})
+	if err != nil {
+		t.Fatalf("GarbageCollect returned an error (%v)", err)
+	}
+	// The manifest, the config and the own layer blobs
+	if removed != 3 {
+		t.Fatalf("GarbageCollect removed %v entries, want 3", removed)
+	}
+	if store.HasBlob(digest.FromBytes(own)) || !store.HasBlob(digest.FromBytes(shared)) {
+		t.Fatalf("GarbageCollect removed the wrong blobs")
+	}
+	if _, err := os.Stat(used); err != nil {
+		t.Fatalf("GarbageCollect removed a layer in use (%v)", err)
+	}
+	removed, _, _ = store.GarbageCollect(nil)
+	if removed != 1 {
+		t.Fatalf("GarbageCollect removed %v entries, want 1", removed)
+	}
+	if _, err := os.Stat(store.LayerPath(digest.FromBytes(shared))); err != nil {
+		t.Fatalf("GarbageCollect removed a layer of a remaining image (%v)", err)
+	}
+	if _, err := store.Lookup("keep"); err != nil {
+		t.Fatalf("the remaining image is gone (%v)", err)
+	}
+}
+
+func TestImageStoreGarbageCollectUnreadable(t *testing.T) {
+	store := newTestStore(t)
+	layer := makeTar(t, map[string]string{"etc/os-release": "fedora"})
+	store.ImportLayout(makeLayout(t, "fedora", layer), "")
+	if _, err := unpackImage(t, store, "fedora"); err != nil {
+		t.Fatalf("Unpack returned an error (%v)", err)
+	}
+	desc, _ := store.Lookup("fedora")
+	manifest, _ := store.ReadManifest(desc)
+	// The config is corrupted, its diff IDs can't be known
+	if err := os.WriteFile(store.BlobPath(manifest.Config.Digest), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.GarbageCollect(nil); err == nil {
+		t.Fatalf("GarbageCollect with a corrupted config returned no error")
+	}
+	if !store.HasBlob(manifest.Layers[0].Digest) {
+		t.Fatalf("GarbageCollect removed the layer blob of a remaining image")
+	}
+	if _, err := os.Stat(store.LayerPath(digest.FromBytes(layer))); err != nil {
+		t.Fatalf("GarbageCollect removed the layer of a remaining image (%v)", err)
+	}
+}
+
+// Unpacks the image ref of the store
+func unpackImage(t *testing.T, store *cmd.ImageStore, ref string) ([]string, error) {
+	desc, err := store.Lookup(ref)
+	if err != nil {
+		t.Fatalf("Lookup returned an error (%v)", err)
+	}
+	manifest, err := store.ReadManifest(desc)
+	if err != nil {
+		t.Fatalf("ReadManifest returned an error (%v)", err)
+	}
+	config, err := store.ReadConfig(manifest.Config)
+	if err != nil {
+		t.Fatalf("ReadConfig returned an error (%v)", err)
+	}
+	return store.Unpack(manifest, config)
+}
+
+func TestImageStoreUnpackDiffID(t *testing.T) {
+	store := newTestStore(t)
+	layer := makeTar(t, map[string]string{"etc/os-release": "fedora"})
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(layer)
+	gz.Close()
+	diffIDs := []digest.Digest{digest.FromBytes(layer)}
+	store.ImportLayout(makeLayoutDiffIDs(t, "plain", specs.MediaTypeImageLayer, [][]byte{layer}, diffIDs), "")
+	store.ImportLayout(makeLayoutDiffIDs(t, "gzip", specs.MediaTypeImageLayerGzip, [][]byte{compressed.Bytes()}, diffIDs), "")
+	store.ImportLayout(makeLayoutDiffIDs(t, "wrong", specs.MediaTypeImageLayerGzip, [][]byte{compressed.Bytes()},
+		[]digest.Digest{digest.FromBytes(compressed.Bytes())}), "")
+
+	plain, err := unpackImage(t, store, "plain")
+	if err != nil {
+		t.Fatalf("Unpack returned an error (%v)", err)
+	}
+	// The same content, compressed, is not unpacked again
+	os.WriteFile(filepath.Join(plain[0], "marker"), nil, 0644)
+	gzipped, err := unpackImage(t, store, "gzip")
+	if err != nil {
+		t.Fatalf("Unpack returned an error (%v)", err)
+	}
+	if gzipped[0] != plain[0] || !utils.PathExists(filepath.Join(gzipped[0], "marker")) {
+		t.Fatalf("the gzip layer was unpacked in %v, want the plain layer %v", gzipped[0], plain[0])
+	}
+
+	_, err = unpackImage(t, store, "wrong")
+	var derr *utils.DiffIDError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Unpack returned %v, want a DiffIDError", err)
+	}
+	if utils.PathExists(store.LayerPath(digest.FromBytes(compressed.Bytes()))) {
+		t.Fatalf("the layer not matching its diff ID was unpacked")
+	}
+}
@@ -14,15 +14,27 @@ import (
 )
 
 var (
+	WRITE       uintptr = 1
+	OPEN        uintptr = 2
+	CLOSE       uintptr = 3
+	IOCTL       uintptr = 16
+	DUP2        uintptr = 33
 	EXECVE      uintptr = 59
 	WAIT4       uintptr = 61
+	KILL        uintptr = 62
 	CHDIR       uintptr = 80
+	SETUID      uintptr = 105
+	SETGID      uintptr = 106
+	SETSID      uintptr = 112
+	SETGROUPS   uintptr = 116
 	PIVOTROOT   uintptr = 155
 	CHROOT      uintptr = 161
 	MOUNT       uintptr = 165
 	UMOUNT      uintptr = 166
 	SETHOSTNAME uintptr = 170
 	UNSHARE     uintptr = 272
+	SETNS       uintptr = 308
+	PIDFDSIGNAL uintptr = 424
 	CLONE3      uintptr = 435
 )
 
@@ -124,6 +136,10 @@ var (
 	MS_MGC_MSK uintptr = 0xffff0000
 )
 
+var (
+	O_PATH int = 0x200000 /* Obtain a file descriptor without opening the file */
+)
+
 // Fork executes the clone3 syscalls.
 // It accepts a struct Cloneargs, which mirrors the clone_args struct (see man 2 clone)
 // If no CloneArgs is passed, it will use default flags (CLONE_VFORK | CLONE_FILES)
@@ -178,16 +194,78 @@ func Exec(args *ExecArgs) (err syscall.Errno) {
 	return syscall.Errno(0)
 }
 
-// Wait waits for the pid to change state.
-// It takes the PID of the process to wait on and returns the pid of the process.
-func Wait(pid int) (status int) {
-	var wstatus uintptr
-	p, _, err := syscall.RawSyscall(WAIT4, uintptr(pid), wstatus, 0)
-	slog.Debug("wait4 returns", "status", wstatus, "pid", p, "err", err)
-	if err != 0 {
-		slog.Debug("wait4", "error", err)
+// WaitStatus is the decoded status of a process returned by wait4.
+type WaitStatus struct {
+	Pid        int
+	ExitCode   int
+	Signal     syscall.Signal
+	CoreDumped bool
+}
+
+// Returns true if the process was terminated by a signal
+func (w WaitStatus) Signaled() bool {
+	return w.Signal != 0
+}
+
+// ExitStatus returns the exit code of the process or, if the process was
+// terminated by a signal, 128 plus the signal number, as shells do.
+func (w WaitStatus) ExitStatus() int {
+	if w.Signaled() {
+		return 128 + int(w.Signal)
+	}
+	return w.ExitCode
+}
+
+func (w WaitStatus) String() string {
+	if !w.Signaled() {
+		return fmt.Sprintf("exited with code %d", w.ExitCode)
+	}
+	if w.CoreDumped {
+		return fmt.Sprintf("killed by signal %d (%v, core dumped)", int(w.Signal), w.Signal)
+	}
+	return fmt.Sprintf("killed by signal %d (%v)", int(w.Signal), w.Signal)
+}
+
+// Decodes the status filled by wait4 (see WIFEXITED, WTERMSIG and friends)
+func decodeWaitStatus(pid int, wstatus uint32) WaitStatus {
+	ws := WaitStatus{Pid: pid}
+	if wstatus&0x7f == 0 {
+		ws.ExitCode = int((wstatus >> 8) & 0xff)
+		return ws
+	}
+	ws.Signal = syscall.Signal(wstatus & 0x7f)
+	ws.CoreDumped = wstatus&0x80 != 0
+	return ws
+}
+
+// Wait waits for the pid to terminate.
+// It takes the PID of the process to wait on and returns its decoded status.
+func Wait(pid int) (WaitStatus, syscall.Errno) {
+	return Wait4(pid, 0)
+}
+
+// Wait4 executes the wait4 syscall with the given options (e.g. WNOHANG).
+// A pid of -1 waits for any child. With WNOHANG, the returned Pid is 0 if
+// no child has terminated yet.
+// Unlike the other syscalls here, wait4 blocks, so it goes through the
+// scheduler-aware Syscall6 to let the other goroutines run meanwhile.
+func Wait4(pid int, options int) (WaitStatus, syscall.Errno) {
+	var wstatus uint32
+	for {
+		p, _, err := syscall.Syscall6(WAIT4, uintptr(pid), uintptr(unsafe.Pointer(&wstatus)), uintptr(options), 0, 0, 0)
+		slog.Debug("wait4 returns", "status", wstatus, "pid", p, "err", err)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != 0 {
+			slog.Debug("wait4", "error", err)
+			return WaitStatus{Pid: pid}, err
+		}
+		if p == 0 {
+			return WaitStatus{}, 0
+		}
+		return decodeWaitStatus(int(p), wstatus), 0
 	}
-	return int(pid)
 }
 
 // Chroot changes the root directory of the process to the specified path.
@@ -348,3 +426,128 @@ func SetHostname(hostname string, size int) (err syscall.Errno) {
 	_, _, error := syscall.RawSyscall(SETHOSTNAME, uintptr(unsafe.Pointer(hostnamep)), uintptr(size), 0)
 	return error
 }
+
+// Send a signal to a process.
+// A zero signal only checks that the process exists.
+func Kill(pid int, sig syscall.Signal) (err syscall.Errno) {
+	slog.Debug("Kill", "pid", pid, "signal", sig)
+	if pid <= 0 {
+		return syscall.EINVAL
+	}
+	_, _, error := syscall.RawSyscall(KILL, uintptr(pid), uintptr(sig), 0)
+	return error
+}
+
+// Open a file and return its file descriptor.
+// This is meant to be used by the child process, where the Go runtime
+// helpers cannot be trusted.
+func Open(path string, flags int) (fd int, err syscall.Errno) {
+	slog.Debug("Open", "path", path, "flags", flags)
+	if len(path) == 0 {
+		return -1, syscall.EINVAL
+	}
+	pathp, e := syscall.BytePtrFromString(path)
+	if e != nil {
+		log.Fatal("Error converting path to pointer")
+	}
+	r, _, error := syscall.RawSyscall(OPEN, uintptr(unsafe.Pointer(pathp)), uintptr(flags), 0)
+	if error != 0 {
+		return -1, error
+	}
+	return int(r), 0
+}
+
+// Write a buffer to a file descriptor
+func Write(fd int, buf []byte) (n int, err syscall.Errno) {
+	if len(buf) == 0 {
+		return 0, 0
+	}
+	r, _, error := syscall.RawSyscall(WRITE, uintptr(fd), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	return int(r), error
+}
+
+// Close a file descriptor
+func Close(fd int) (err syscall.Errno) {
+	_, _, error := syscall.RawSyscall(CLOSE, uintptr(fd), 0, 0)
+	return error
+}
+
+// Set the supplementary groups of the process
+func Setgroups(gids []int) (err syscall.Errno) {
+	slog.Debug("Setgroups", "pid", os.Getpid(), "gids", gids)
+	if len(gids) == 0 {
+		_, _, error := syscall.RawSyscall(SETGROUPS, 0, 0, 0)
+		return error
+	}
+	groups := make([]uint32, len(gids))
+	for i, gid := range gids {
+		groups[i] = uint32(gid)
+	}
+	_, _, error := syscall.RawSyscall(SETGROUPS, uintptr(len(groups)), uintptr(unsafe.Pointer(&groups[0])), 0)
+	return error
+}
+
+// Set the group id of the process
+func Setgid(gid int) (err syscall.Errno) {
+	slog.Debug("Setgid", "pid", os.Getpid(), "gid", gid)
+	_, _, error := syscall.RawSyscall(SETGID, uintptr(gid), 0, 0)
+	return error
+}
+
+// Set the user id of the process
+func Setuid(uid int) (err syscall.Errno) {
+	slog.Debug("Setuid", "pid", os.Getpid(), "uid", uid)
+	_, _, error := syscall.RawSyscall(SETUID, uintptr(uid), 0, 0)
+	return error
+}
+
+// Switch the process to the given user.
+// The groups are set first, as it won't be possible anymore once the
+// user isn't root.
+func SwitchUser(u *utils.ExecUser) (err syscall.Errno) {
+	err = Setgroups(u.Groups)
+	if err != 0 {
+		return err
+	}
+	err = Setgid(u.Gid)
+	if err != 0 {
+		return err
+	}
+	return Setuid(u.Uid)
+}
+
+// Send a signal to the process referred to by a pidfd
+func PidfdSendSignal(pidfd int, sig syscall.Signal) (err syscall.Errno) {
+	slog.Debug("PidfdSendSignal", "pidfd", pidfd, "signal", sig)
+	if pidfd < 0 {
+		return syscall.EBADF
+	}
+	_, _, error := syscall.RawSyscall6(PIDFDSIGNAL, uintptr(pidfd), uintptr(sig), 0, 0, 0, 0)
+	return error
+}
+
+// Control a device (see man 2 ioctl)
+func Ioctl(fd int, request uintptr, arg uintptr) (err syscall.Errno) {
+	_, _, error := syscall.RawSyscall(IOCTL, uintptr(fd), request, arg)
+	return error
+}
+
+// Duplicate oldfd into newfd
+func Dup2(oldfd, newfd int) (err syscall.Errno) {
+	_, _, error := syscall.RawSyscall(DUP2, uintptr(oldfd), uintptr(newfd), 0)
+	return error
+}
+
+// Create a new session, with the process as its leader
+func Setsid() (sid int, err syscall.Errno) {
+	r, _, error := syscall.RawSyscall(SETSID, 0, 0, 0)
+	return int(r), error
+}
+
+// Join the namespace referred to by fd.
+// nstype is the CLONE_NEW* flag of the namespace type (0 allows any type).
+func Setns(fd int, nstype uint64) (err syscall.Errno) {
+	slog.Debug("Setns", "pid", os.Getpid(), "fd", fd, "nstype", nstype)
+	_, _, error := syscall.RawSyscall(SETNS, uintptr(fd), uintptr(nstype), 0)
+	return error
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"log/slog"
+)
+
+var (
+	tty         bool
+	interactive bool
+	// How long the output of the container terminal is copied once its
+	// process is gone
+	TERMINAL_DRAIN_TIMEOUT = time.Second
+)
+
+// Winsize mirrors the kernel struct winsize (see man 2 ioctl_tty)
+type Winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// OpenPty allocates a new pseudo-terminal.
+// It returns the master side and the path of the slave side.
+// The master side is non-blocking, so closing it interrupts its reads: its
+// Fd method, which makes it blocking, must not be called.
+func OpenPty() (*os.File, string, error) {
+	fd, err := syscall.Open("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var unlock int32 = 0
+	if errno := Ioctl(fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		syscall.Close(fd)
+		return nil, "", errno
+	}
+	var ptn uint32
+	if errno := Ioctl(fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptn))); errno != 0 {
+		syscall.Close(fd)
+		return nil, "", errno
+	}
+	slave := "/dev/pts/" + strconv.Itoa(int(ptn))
+	slog.Debug("OpenPty", "master", fd, "slave", slave)
+	return os.NewFile(uintptr(fd), "/dev/ptmx"), slave, nil
+}
+
+// Returns true if fd refers to a terminal
+func IsTerminal(fd int) bool {
+	var termios syscall.Termios
+	return Ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == 0
+}
+
+// SetRawTerminal puts the terminal in raw mode (see cfmakeraw in man 3 termios),
+// so every key press goes untouched to the container.
+// It returns the previous settings, to be restored with RestoreTerminal.
+func SetRawTerminal(fd int) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if errno := Ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return nil, errno
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if errno := Ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); errno != 0 {
+		return nil, errno
+	}
+	return &old, nil
+}
+
+// SetNoEchoTerminal stops the terminal from echoing what is typed, e.g. a
+// password.
+// It returns the previous settings, to be restored with RestoreTerminal.
+func SetNoEchoTerminal(fd int) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if errno := Ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return nil, errno
+	}
+	noecho := old
+	noecho.Lflag &^= syscall.ECHO
+	noecho.Lflag |= syscall.ICANON | syscall.ISIG
+	if errno := Ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&noecho))); errno != 0 {
+		return nil, errno
+	}
+	return &old, nil
+}
+
+// Restores the terminal settings saved by SetRawTerminal or SetNoEchoTerminal
+func RestoreTerminal(fd int, termios *syscall.Termios) {
+	if termios == nil {
+		return
+	}
+	Ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(termios)))
+}
+
+// Copies the window size of the terminal from to the terminal to
+func ResizeTerminal(from, to int) syscall.Errno {
+	var ws Winsize
+	if errno := Ioctl(from, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return errno
+	}
+	slog.Debug("ResizeTerminal", "rows", ws.Row, "cols", ws.Col)
+	return Ioctl(to, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// Terminal is the host side of the container pseudo-terminal.
+type Terminal struct {
+	Master *os.File
+	Slave  string
+	state  *syscall.Termios
+	winch  chan os.Signal
+	done   chan struct{}
+}
+
+// NewTerminal allocates the pseudo-terminal of a container,
+// sized as the rocked terminal.
+func NewTerminal() (*Terminal, error) {
+	master, slave, err := OpenPty()
+	if err != nil {
+		return nil, err
+	}
+	t := &Terminal{
+		Master: master,
+		Slave:  slave,
+		done:   make(chan struct{}),
+	}
+	t.resize(int(os.Stdin.Fd()))
+	return t, nil
+}
+
+// Copies the window size of the terminal from to the container terminal
+func (t *Terminal) resize(from int) {
+	conn, err := t.Master.SyscallConn()
+	if err != nil {
+		return
+	}
+	conn.Control(func(fd uintptr) {
+		ResizeTerminal(from, int(fd))
+	})
+}
+
+// Proxy puts the rocked terminal in raw mode and copies the container output
+// to the standard output and, if interactive, the standard input to the container.
+// The window size changes are propagated to the container terminal.
+func (t *Terminal) Proxy(interactive bool) {
+	stdin := int(os.Stdin.Fd())
+	if IsTerminal(stdin) {
+		state, err := SetRawTerminal(stdin)
+		if err != nil {
+			log.Printf("Error setting the terminal in raw mode: %v", err)
+		}
+		t.state = state
+		t.winch = make(chan os.Signal, 1)
+		signal.Notify(t.winch, syscall.SIGWINCH)
+		go func() {
+			for range t.winch {
+				t.resize(stdin)
+			}
+		}()
+	}
+	if interactive {
+		go io.Copy(t.Master, os.Stdin)
+	}
+	go func() {
+		// This returns EIO once the container closes the slave side
+		io.Copy(os.Stdout, t.Master)
+		close(t.done)
+	}()
+}
+
+// Close waits for the container output to be copied and restores the rocked terminal.
+// As processes left in the container may still hold the slave side open, the
+// output is waited for TERMINAL_DRAIN_TIMEOUT at most.
+func (t *Terminal) Close() {
+	select {
+	case <-t.done:
+	case <-time.After(TERMINAL_DRAIN_TIMEOUT):
+		slog.Debug("Terminal: the slave side is still open", "slave", t.Slave)
+		// Closing the master ends the copy of the output
+		t.Master.Close()
+		<-t.done
+	}
+	if t.winch != nil {
+		signal.Stop(t.winch)
+		close(t.winch)
+	}
+	RestoreTerminal(int(os.Stdin.Fd()), t.state)
+	t.Master.Close()
+}
+
+// setupStdio sets up the standard input, output and error of the container
+// process, in the child.
+// With a terminal (ttyfd >= 0), the process gets a new session with the
+// terminal as controlling terminal and as standard output and error, and as
+// standard input if interactive (there's nothing to read from it otherwise).
+// Without a terminal, they're inherited from rocked.
+func setupStdio(ttyfd int, interactive bool) {
+	if ttyfd < 0 {
+		return
+	}
+	if _, err := Setsid(); err != 0 {
+		log.Fatal("Error creating a new session: ", err)
+	}
+	if err := Ioctl(ttyfd, syscall.TIOCSCTTY, 0); err != 0 {
+		log.Fatal("Error setting the controlling terminal: ", err)
+	}
+	stdin := ttyfd
+	if !interactive {
+		null, err := Open("/dev/null", syscall.O_RDONLY)
+		if err != 0 {
+			log.Fatal("Error opening /dev/null: ", err)
+		}
+		stdin = null
+	}
+	if err := Dup2(stdin, 0); err != 0 {
+		log.Fatal("Error setting up the standard input: ", err)
+	}
+	for fd := 1; fd <= 2; fd++ {
+		if err := Dup2(ttyfd, fd); err != 0 {
+			log.Fatal("Error setting up the terminal: ", err)
+		}
+	}
+	if stdin != ttyfd {
+		Close(stdin)
+	}
+	Close(ttyfd)
+}
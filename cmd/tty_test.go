@@ -0,0 +1,74 @@
+package cmd_test
+
+import (
+	"os"
+	"rocked/cmd"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOpenPty(t *testing.T) {
+	master, slavePath, err := cmd.OpenPty()
+	if err != nil {
+		t.Fatalf("OpenPty returned an error (%v)", err)
+	}
+	defer master.Close()
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatalf("Could not open the slave %v (%v)", slavePath, err)
+	}
+	defer slave.Close()
+	if !cmd.IsTerminal(int(slave.Fd())) {
+		t.Fatalf("%v is not a terminal", slavePath)
+	}
+	old, err := cmd.SetRawTerminal(int(slave.Fd()))
+	if err != nil {
+		t.Fatalf("SetRawTerminal returned an error (%v)", err)
+	}
+	// In raw mode there is no output processing, "\n" is not turned into "\r\n"
+	slave.Write([]byte("hello\n"))
+	buf := make([]byte, 16)
+	n, err := master.Read(buf)
+	if err != nil || string(buf[:n]) != "hello\n" {
+		t.Errorf("got %q (%v) want %q", buf[:n], err, "hello\n")
+	}
+	cmd.RestoreTerminal(int(slave.Fd()), old)
+}
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "notatty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if cmd.IsTerminal(int(f.Fd())) {
+		t.Errorf("a regular file is reported as a terminal")
+	}
+}
+
+func TestTerminalCloseSlaveOpen(t *testing.T) {
+	term, err := cmd.NewTerminal()
+	if err != nil {
+		t.Fatalf("NewTerminal returned an error (%v)", err)
+	}
+	// A process left in the container keeps the slave side open
+	slave, err := os.OpenFile(term.Slave, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatalf("Could not open the slave %v (%v)", term.Slave, err)
+	}
+	defer slave.Close()
+	defer func(timeout time.Duration) { cmd.TERMINAL_DRAIN_TIMEOUT = timeout }(cmd.TERMINAL_DRAIN_TIMEOUT)
+	cmd.TERMINAL_DRAIN_TIMEOUT = 10 * time.Millisecond
+	term.Proxy(false)
+	closed := make(chan struct{})
+	go func() {
+		term.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close hangs while the slave side is open")
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"rocked/specs"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+// BlobVerificationError is returned when the content of a blob doesn't match
+// its descriptor
+type BlobVerificationError struct {
+	Digest digest.Digest
+	Reason string
+}
+
+func (e *BlobVerificationError) Error() string {
+	return fmt.Sprintf("blob %v is corrupted: %v", e.Digest, e.Reason)
+}
+
+// verifyingReader checks the content read through it against a descriptor.
+// The reads fail once more bytes than the descriptor size are read and, at
+// the end, if the size or the digest don't match.
+type verifyingReader struct {
+	file     *os.File
+	desc     specs.Descriptor
+	verifier digest.Verifier
+	read     int64
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.file.Read(b)
+	v.read += int64(n)
+	v.verifier.Write(b[:n])
+	if v.desc.Size > 0 && v.read > v.desc.Size {
+		return n, &BlobVerificationError{Digest: v.desc.Digest, Reason: fmt.Sprintf("larger than %v bytes", v.desc.Size)}
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if v.desc.Size > 0 && v.read != v.desc.Size {
+		return n, &BlobVerificationError{Digest: v.desc.Digest, Reason: fmt.Sprintf("%v bytes, expected %v", v.read, v.desc.Size)}
+	}
+	if !v.verifier.Verified() {
+		return n, &BlobVerificationError{Digest: v.desc.Digest, Reason: "content does not match the digest"}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.file.Close()
+}
+
+// OpenBlob opens the blob described by desc.
+// Its content is verified against the descriptor digest and size while read:
+// the read reaching the end of the blob fails with a BlobVerificationError if
+// they don't match. A zero size is taken as unknown, only the digest is then
+// verified.
+func (s *ImageStore) OpenBlob(desc specs.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	if !IsValidAlgorithm(desc.Digest.Algorithm().String()) {
+		return nil, &AlgorithmError{}
+	}
+	if desc.Size < 0 {
+		return nil, &BlobVerificationError{Digest: desc.Digest, Reason: fmt.Sprintf("invalid size %v", desc.Size)}
+	}
+	f, err := os.Open(s.BlobPath(desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{file: f, desc: desc, verifier: desc.Digest.Verifier()}, nil
+}
+
+// VerifyBlob reads the whole blob described by desc, verifying it
+func (s *ImageStore) VerifyBlob(desc specs.Descriptor) error {
+	r, err := s.OpenBlob(desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// Verify verifies the blobs of the images named refs or, without refs, of
+// all the images of the store: the manifests, image indexes, configs and
+// layers.
+// The manifests of an image index missing from the store (e.g. loaded for a
+// single platform) are skipped.
+// It returns the number of blobs verified and an error for every blob
+// missing or corrupted.
+func (s *ImageStore) Verify(refs []string) (int, []error) {
+	var roots []specs.Descriptor
+	var errs []error
+	if len(refs) == 0 {
+		index, err := s.ReadIndex()
+		if err != nil {
+			return 0, []error{err}
+		}
+		roots = index.Manifests
+	}
+	for _, ref := range refs {
+		desc, err := s.Lookup(ref)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		roots = append(roots, desc)
+	}
+	verified := map[digest.Digest]bool{}
+	verify := func(desc specs.Descriptor) bool {
+		if verified[desc.Digest] {
+			return false
+		}
+		verified[desc.Digest] = true
+		slog.Debug("ImageStore: Verify", "blob", desc.Digest, "mediaType", desc.MediaType)
+		if err := s.VerifyBlob(desc); err != nil {
+			errs = append(errs, fmt.Errorf("%v %v: %w", desc.MediaType, desc.Digest, err))
+			return false
+		}
+		return true
+	}
+	var walk func(desc specs.Descriptor)
+	walk = func(desc specs.Descriptor) {
+		if !verify(desc) {
+			return
+		}
+		switch {
+		case specs.IsImageIndex(desc.MediaType):
+			var nested specs.Index
+			if err := s.readJSONBlob(desc, &nested); err != nil {
+				errs = append(errs, err)
+				return
+			}
+			for _, m := range nested.Manifests {
+				if !s.HasBlob(m.Digest) {
+					slog.Debug("ImageStore: Verify missing manifest", "manifest", m.Digest, "platform", m.Platform)
+					continue
+				}
+				walk(m)
+			}
+		case specs.IsImageManifest(desc.MediaType):
+			manifest, err := s.ReadManifest(desc)
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			verify(manifest.Config)
+			for _, layer := range manifest.Layers {
+				verify(layer)
+			}
+		}
+	}
+	for _, desc := range roots {
+		walk(desc)
+	}
+	return len(verified), errs
+}
+
+func verifyImages(refs []string) {
+	store := openImageStore()
+	verified, errs := store.Verify(refs)
+	for _, err := range errs {
+		log.Print(err)
+	}
+	if len(errs) != 0 {
+		log.Fatalf("The verification of %d blobs found %d errors", verified, len(errs))
+	}
+	fmt.Printf("Verified %d blobs\n", verified)
+}
+
+// imageVerifyCmd represents the image verify command
+var imageVerifyCmd = &cobra.Command{
+	Use:   "verify [image]...",
+	Short: "Verifies the digest and size of the blobs of images, all of them by default",
+	Run: func(cmd *cobra.Command, args []string) {
+		verifyImages(args)
+	},
+}
+
+func init() {
+	imageCmd.AddCommand(imageVerifyCmd)
+}
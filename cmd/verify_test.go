@@ -0,0 +1,58 @@
+package cmd_test
+
+import (
+	"errors"
+	"os"
+	"rocked/cmd"
+	"testing"
+)
+
+func TestImageStoreVerify(t *testing.T) {
+	store := newTestStore(t)
+	layer := makeTar(t, map[string]string{"etc/os-release": "fedora"})
+	if _, err := store.ImportLayout(makeLayout(t, "fedora", layer), ""); err != nil {
+		t.Fatalf("ImportLayout returned an error (%v)", err)
+	}
+	verified, errs := store.Verify(nil)
+	if len(errs) != 0 {
+		t.Fatalf("Verify returned errors (%v)", errs)
+	}
+	// The manifest, the config and the layer
+	if verified != 3 {
+		t.Fatalf("Verify verified %v blobs, want 3", verified)
+	}
+
+	desc, _ := store.Lookup("fedora")
+	manifest, _ := store.ReadManifest(desc)
+	config, _ := store.ReadConfig(manifest.Config)
+	tampered := append([]byte{}, layer...)
+	tampered[len(tampered)/2] ^= 0xff
+	if err := os.WriteFile(store.BlobPath(manifest.Layers[0].Digest), tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, errs = store.Verify([]string{"fedora"})
+	var verr *cmd.BlobVerificationError
+	if len(errs) != 1 || !errors.As(errs[0], &verr) || verr.Digest != manifest.Layers[0].Digest {
+		t.Fatalf("Verify returned %v, want a BlobVerificationError for %v", errs, manifest.Layers[0].Digest)
+	}
+	if _, err := store.Unpack(manifest, config); !errors.As(err, &verr) {
+		t.Fatalf("Unpack of a corrupted layer returned %v, want a BlobVerificationError", err)
+	}
+	if _, err := os.Stat(store.LayerPath(config.RootFS.DiffIDs[0])); err == nil {
+		t.Fatalf("the corrupted layer was unpacked")
+	}
+}
+
+func TestImageStoreReadWrongSize(t *testing.T) {
+	store := newTestStore(t)
+	store.ImportLayout(makeLayout(t, "fedora", makeTar(t, map[string]string{"a": "a"})), "")
+	desc, _ := store.Lookup("fedora")
+	for _, size := range []int64{desc.Size - 1, desc.Size + 1} {
+		wrong := desc
+		wrong.Size = size
+		var verr *cmd.BlobVerificationError
+		if _, err := store.ReadManifest(wrong); !errors.As(err, &verr) {
+			t.Fatalf("ReadManifest with size %v returned %v, want a BlobVerificationError", size, err)
+		}
+	}
+}
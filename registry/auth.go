@@ -0,0 +1,253 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// The username of the credentials whose password is an identity token,
+	// as with docker
+	IDENTITY_TOKEN_USERNAME = "<token>"
+	// The client id sent when exchanging an identity token
+	TOKEN_CLIENT_ID = "rocked"
+)
+
+// request is a request to a registry, built again for every attempt
+type request struct {
+	method string
+	url    string
+	header http.Header
+	// Returns the body of an attempt, nil for none
+	body          func() (io.Reader, error)
+	contentLength int64
+	// The token scopes needed, e.g. repository:library/fedora:pull
+	scopes []string
+}
+
+// Parses a WWW-Authenticate challenge, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for len(rest) != 0 {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return strings.ToLower(scheme), params
+}
+
+// Returns the cache key of the token of host for scopes
+func tokenKey(host string, scopes []string) string {
+	return host + " " + strings.Join(scopes, " ")
+}
+
+// Returns the credentials of host, if any
+func (c *Client) credentials(host string) (string, string, error) {
+	if c.Credentials == nil {
+		return "", "", nil
+	}
+	return c.Credentials(host)
+}
+
+// Sets the authorization of an attempt to host, from what the previous ones
+// taught
+func (c *Client) authorize(req *http.Request, host string, scopes []string) error {
+	c.mu.Lock()
+	token := c.tokens[tokenKey(host, scopes)]
+	basic := c.basic[host]
+	c.mu.Unlock()
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if basic {
+		username, password, err := c.credentials(host)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(username, password)
+	}
+	return nil
+}
+
+// Handles the authentication challenge of host.
+// For a bearer challenge, a token for scopes is obtained from the realm,
+// with the credentials of host if any. For a basic one, the credentials are
+// sent with the following requests.
+func (c *Client) authenticate(ctx context.Context, host, challenge string, scopes []string) error {
+	scheme, params := parseChallenge(challenge)
+	slog.Debug("Client: authenticate", "host", host, "scheme", scheme, "params", params)
+	username, password, err := c.credentials(host)
+	if err != nil {
+		return err
+	}
+	switch scheme {
+	case "basic":
+		if len(username) == 0 {
+			return fmt.Errorf("%v requires credentials", host)
+		}
+		c.mu.Lock()
+		if c.basic == nil {
+			c.basic = map[string]bool{}
+		}
+		c.basic[host] = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported authentication scheme %q from %v", scheme, host)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || len(realm.Host) == 0 {
+		return fmt.Errorf("invalid token realm %q from %v", params["realm"], host)
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	var req *http.Request
+	if username == IDENTITY_TOKEN_USERNAME {
+		// The identity token is an OAuth2 refresh token
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {password},
+			"client_id":     {TOKEN_CLIENT_ID},
+			"scope":         {strings.Join(scopes, " ")},
+		}
+		if service, ok := params["service"]; ok {
+			form.Set("service", service)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		realm.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return err
+		}
+		if len(username) != 0 {
+			req.SetBasicAuth(username, password)
+		}
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("decoding the token from %v: %w", realm.Host, err)
+	}
+	if len(token.Token) == 0 {
+		token.Token = token.AccessToken
+	}
+	if len(token.Token) == 0 {
+		return fmt.Errorf("no token from %v", realm.Host)
+	}
+	c.mu.Lock()
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+	c.tokens[tokenKey(host, scopes)] = token.Token
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
+
+// Sends the request r to host, authenticating if the registry asks to.
+// A request without a body, or whose body can be built again, is retried
+// once authenticated.
+func (c *Client) do(ctx context.Context, host string, r *request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var body io.Reader
+		if r.body != nil {
+			var err error
+			if body, err = r.body(); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, r.method, r.url, body)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range r.header {
+			req.Header[key] = values
+		}
+		if r.body != nil {
+			req.ContentLength = r.contentLength
+		}
+		if err := c.authorize(req, host, r.scopes); err != nil {
+			return nil, err
+		}
+		resp, err := c.httpClient().Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, err
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authenticate(ctx, host, challenge, r.scopes); err != nil {
+			return nil, fmt.Errorf("authenticating to %v: %w", host, err)
+		}
+	}
+}
+
+// Login checks the credentials username and password on the registry host,
+// pinging its API with them. A registry issuing tokens has to grant one for
+// them, one asking for basic authentication has to accept them.
+// A registry letting anonymous clients in accepts any credentials.
+func (c *Client) Login(ctx context.Context, host, username, password string) error {
+	host = RegistryHost(host)
+	slog.Debug("Client: Login", "host", host, "username", username)
+	login := &Client{
+		HTTP:      c.HTTP,
+		PlainHTTP: c.PlainHTTP,
+		Credentials: func(string) (string, string, error) {
+			return username, password, nil
+		},
+	}
+	resp, err := login.do(ctx, host, &request{method: http.MethodGet, url: login.apiURL(host)})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
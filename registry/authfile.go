@@ -0,0 +1,354 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// The environment variable with the path of the credentials file
+	AUTH_FILE_ENV = "REGISTRY_AUTH_FILE"
+	// The prefix of the credential helper executables, as docker's
+	CREDENTIAL_HELPER_PREFIX = "docker-credential-"
+	// The key of docker.io in the credentials files written by docker
+	DOCKER_HUB_AUTH_KEY = "https://index.docker.io/v1/"
+	// The error message of a credential helper without the credentials
+	// asked for
+	helperNotFound = "credentials not found in native keychain"
+)
+
+// ErrNotLoggedIn is returned when removing the credentials of a registry
+// without any
+var ErrNotLoggedIn = errors.New("not logged in")
+
+// AuthConfig is the entry of a registry in a credentials file.
+// The other fields of the entry are preserved.
+type AuthConfig struct {
+	// The base64 encoding of username:password
+	Auth string `json:"auth,omitempty"`
+	// The credentials in clear, as some tools write them instead of Auth
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// An OAuth2 refresh token, exchanged for the registry tokens
+	IdentityToken string `json:"identitytoken,omitempty"`
+	other         map[string]json.RawMessage
+}
+
+// The fields of AuthConfig
+var authConfigKeys = []string{"auth", "username", "password", "identitytoken"}
+
+func (c *AuthConfig) UnmarshalJSON(data []byte) error {
+	type authConfig AuthConfig
+	if err := json.Unmarshal(data, (*authConfig)(c)); err != nil {
+		return err
+	}
+	c.other = map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &c.other); err != nil {
+		return err
+	}
+	for _, key := range authConfigKeys {
+		delete(c.other, key)
+	}
+	return nil
+}
+
+func (c AuthConfig) MarshalJSON() ([]byte, error) {
+	type authConfig AuthConfig
+	data, err := json.Marshal(authConfig(c))
+	if err != nil || len(c.other) == 0 {
+		return data, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range c.other {
+		fields[key] = value
+	}
+	return json.Marshal(fields)
+}
+
+// AuthFile is a credentials file in the format of docker's config.json, e.g.
+//
+//	{"auths": {"quay.io": {"auth": "dXNlcjpzZWNyZXQ="}},
+//	 "credHelpers": {"gcr.io": "gcloud"}}
+//
+// The credentials of the registries in credHelpers, or of all of them if
+// credsStore is set, are kept by the docker-credential-<helper> executable
+// instead.
+// The other fields of the file are preserved.
+type AuthFile struct {
+	Path        string                `json:"-"`
+	Auths       map[string]AuthConfig `json:"auths,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	other       map[string]json.RawMessage
+}
+
+// DefaultAuthFile returns the path of the credentials file:
+// $REGISTRY_AUTH_FILE if set, else rocked/auth.json in the user
+// configuration directory.
+func DefaultAuthFile() (string, error) {
+	if path := os.Getenv(AUTH_FILE_ENV); len(path) != 0 {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rocked", "auth.json"), nil
+}
+
+// LoadAuthFile reads the credentials file path.
+// A missing file has no credentials.
+func LoadAuthFile(path string) (*AuthFile, error) {
+	slog.Debug("LoadAuthFile", "path", path)
+	f := &AuthFile{Path: path, other: map[string]json.RawMessage{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.other); err != nil {
+		return nil, fmt.Errorf("decoding %v: %w", path, err)
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("decoding %v: %w", path, err)
+	}
+	for _, key := range []string{"auths", "credHelpers", "credsStore"} {
+		delete(f.other, key)
+	}
+	return f, nil
+}
+
+// Save writes the credentials file, readable by its owner only
+func (f *AuthFile) Save() error {
+	slog.Debug("AuthFile: Save", "path", f.Path)
+	fields := map[string]any{}
+	for key, value := range f.other {
+		fields[key] = value
+	}
+	if len(f.Auths) != 0 {
+		fields["auths"] = f.Auths
+	} else {
+		fields["auths"] = struct{}{}
+	}
+	if len(f.CredHelpers) != 0 {
+		fields["credHelpers"] = f.CredHelpers
+	}
+	if len(f.CredsStore) != 0 {
+		fields["credsStore"] = f.CredsStore
+	}
+	data, err := json.MarshalIndent(fields, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(f.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(f.Path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Returns the key of the registry host in the credentials file: the host
+// without scheme and path, docker.io for the docker hub
+func authKey(host string) string {
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if isDockerHub(host) {
+		return DEFAULT_REGISTRY
+	}
+	return host
+}
+
+// Returns the key of the entry of m for the registry key, which may be
+// written with a scheme, e.g. https://quay.io
+func lookupKey[V any](m map[string]V, key string) (string, bool) {
+	if _, ok := m[key]; ok {
+		return key, true
+	}
+	for k := range m {
+		if authKey(k) == key {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Returns the credential helper of the registry key, if any
+func (f *AuthFile) helper(key string) string {
+	if k, ok := lookupKey(f.CredHelpers, key); ok {
+		return f.CredHelpers[k]
+	}
+	return f.CredsStore
+}
+
+// Returns the server URL of the registry key for the credential helpers
+func helperServer(key string) string {
+	if key == DEFAULT_REGISTRY {
+		return DOCKER_HUB_AUTH_KEY
+	}
+	return key
+}
+
+// Runs the action of the credential helper, e.g. docker-credential-pass get,
+// with input on its standard input.
+// It returns the standard output of the helper.
+func runHelper(helper, action string, input []byte) ([]byte, error) {
+	name := CREDENTIAL_HELPER_PREFIX + helper
+	slog.Debug("runHelper", "helper", name, "action", action)
+	cmd := exec.Command(name, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(string(out) + stderr.String())
+		if strings.Contains(msg, helperNotFound) {
+			return nil, ErrNotLoggedIn
+		}
+		if len(msg) != 0 {
+			return nil, fmt.Errorf("%v %v: %v", name, action, msg)
+		}
+		return nil, fmt.Errorf("%v %v: %w", name, action, err)
+	}
+	return out, nil
+}
+
+// helperCredentials is the message of the credential helpers protocol
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL,omitempty"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// Get returns the credentials of the registry host, from its credential
+// helper if it has one.
+// A registry without credentials has an empty username, one with an identity
+// token has the username IDENTITY_TOKEN_USERNAME and the token as password.
+// It can be used as the Credentials of a Client.
+func (f *AuthFile) Get(host string) (string, string, error) {
+	key := authKey(host)
+	if helper := f.helper(key); len(helper) != 0 {
+		out, err := runHelper(helper, "get", []byte(helperServer(key)))
+		if errors.Is(err, ErrNotLoggedIn) {
+			return "", "", nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		var creds helperCredentials
+		if err := json.Unmarshal(out, &creds); err != nil {
+			return "", "", fmt.Errorf("decoding the credentials of %v from %v%v: %w", key, CREDENTIAL_HELPER_PREFIX, helper, err)
+		}
+		return creds.Username, creds.Secret, nil
+	}
+	k, ok := lookupKey(f.Auths, key)
+	if !ok {
+		return "", "", nil
+	}
+	entry := f.Auths[k]
+	if len(entry.IdentityToken) != 0 {
+		return IDENTITY_TOKEN_USERNAME, entry.IdentityToken, nil
+	}
+	if len(entry.Auth) == 0 {
+		return entry.Username, entry.Password, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("decoding the credentials of %v in %v: %w", key, f.Path, err)
+	}
+	username, password, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid credentials of %v in %v", key, f.Path)
+	}
+	return username, password, nil
+}
+
+// Set sets the credentials of the registry host.
+// Those kept by a credential helper are stored right away, the others when
+// the file is saved.
+func (f *AuthFile) Set(host, username, password string) error {
+	key := authKey(host)
+	if helper := f.helper(key); len(helper) != 0 {
+		input, err := json.Marshal(helperCredentials{ServerURL: helperServer(key), Username: username, Secret: password})
+		if err != nil {
+			return err
+		}
+		if _, err := runHelper(helper, "store", input); err != nil {
+			return err
+		}
+		// Any credentials of the file are stale
+		if k, ok := lookupKey(f.Auths, key); ok {
+			delete(f.Auths, k)
+		}
+		return nil
+	}
+	// The credentials replace the previous ones, the other fields are kept
+	var previous AuthConfig
+	if k, ok := lookupKey(f.Auths, key); ok {
+		previous = f.Auths[k]
+		delete(f.Auths, k)
+	}
+	if f.Auths == nil {
+		f.Auths = map[string]AuthConfig{}
+	}
+	f.Auths[key] = AuthConfig{
+		Auth:  base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		other: previous.other,
+	}
+	return nil
+}
+
+// Remove removes the credentials of the registry host.
+// It returns ErrNotLoggedIn if there are none.
+func (f *AuthFile) Remove(host string) error {
+	key := authKey(host)
+	removed := false
+	if k, ok := lookupKey(f.Auths, key); ok {
+		delete(f.Auths, k)
+		removed = true
+	}
+	if helper := f.helper(key); len(helper) != 0 {
+		_, err := runHelper(helper, "erase", []byte(helperServer(key)))
+		if err == nil {
+			removed = true
+		} else if !errors.Is(err, ErrNotLoggedIn) {
+			return err
+		}
+	}
+	if !removed {
+		return fmt.Errorf("%v: %w", key, ErrNotLoggedIn)
+	}
+	return nil
+}
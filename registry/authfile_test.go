@@ -0,0 +1,174 @@
+package registry_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"rocked/registry"
+	"testing"
+)
+
+func TestAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "containers", "auth.json")
+	// Written by docker, with a field unknown to rocked
+	docker := `{"auths": {"https://index.docker.io/v1/": {"auth": "aHViOmh1YnNlY3JldA==", "email": "hub@example.com"},
+		"gcr.io": {"identitytoken": "refresh", "registrytoken": "access"},
+		"ghcr.io": {"username": "gh", "password": "ghsecret"}}, "detachKeys": "ctrl-x"}`
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(docker), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := registry.LoadAuthFile(path)
+	if err != nil {
+		t.Fatalf("LoadAuthFile returned an error (%v)", err)
+	}
+	for _, host := range []string{"docker.io", registry.DOCKER_HUB_HOST} {
+		username, password, err := file.Get(host)
+		if err != nil || username != "hub" || password != "hubsecret" {
+			t.Fatalf("Get(%v) returned %v, %v, %v", host, username, password, err)
+		}
+	}
+	if username, _, err := file.Get("quay.io"); err != nil || len(username) != 0 {
+		t.Fatalf("Get(quay.io) returned %v, %v", username, err)
+	}
+	if username, password, err := file.Get("gcr.io"); err != nil || username != registry.IDENTITY_TOKEN_USERNAME || password != "refresh" {
+		t.Fatalf("Get(gcr.io) returned %v, %v, %v", username, password, err)
+	}
+	if username, password, err := file.Get("ghcr.io"); err != nil || username != "gh" || password != "ghsecret" {
+		t.Fatalf("Get(ghcr.io) returned %v, %v, %v", username, password, err)
+	}
+	if err := file.Set("localhost:5000", "user", "pa:ss"); err != nil {
+		t.Fatalf("Set returned an error (%v)", err)
+	}
+	if err := file.Set("docker.io", "hub", "newsecret"); err != nil {
+		t.Fatalf("Set returned an error (%v)", err)
+	}
+	if err := file.Save(); err != nil {
+		t.Fatalf("Save returned an error (%v)", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("the credentials file mode is %v", info.Mode())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]any
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("the saved file is invalid (%v): %s", err, data)
+	}
+	if saved["detachKeys"] != "ctrl-x" {
+		t.Fatalf("the unknown fields are lost: %s", data)
+	}
+	auths := saved["auths"].(map[string]any)
+	if len(auths) != 4 || auths["localhost:5000"] == nil || auths["docker.io"] == nil {
+		t.Fatalf("the saved credentials are %v", auths)
+	}
+	// The other fields of the entries are kept
+	if hub := auths["docker.io"].(map[string]any); hub["email"] != "hub@example.com" || hub["auth"] != "aHViOm5ld3NlY3JldA==" {
+		t.Fatalf("the docker.io entry is %v", hub)
+	}
+	if gcr := auths["gcr.io"].(map[string]any); gcr["identitytoken"] != "refresh" || gcr["registrytoken"] != "access" {
+		t.Fatalf("the gcr.io entry is %v", gcr)
+	}
+	if ghcr := auths["ghcr.io"].(map[string]any); ghcr["username"] != "gh" || ghcr["password"] != "ghsecret" {
+		t.Fatalf("the ghcr.io entry is %v", ghcr)
+	}
+
+	file, err = registry.LoadAuthFile(path)
+	if err != nil {
+		t.Fatalf("LoadAuthFile returned an error (%v)", err)
+	}
+	username, password, err := file.Get("localhost:5000")
+	if err != nil || username != "user" || password != "pa:ss" {
+		t.Fatalf("Get returned %v, %v, %v", username, password, err)
+	}
+	if err := file.Remove("localhost:5000"); err != nil {
+		t.Fatalf("Remove returned an error (%v)", err)
+	}
+	if err := file.Remove("localhost:5000"); !errors.Is(err, registry.ErrNotLoggedIn) {
+		t.Fatalf("Remove of a missing host returned %v", err)
+	}
+}
+
+func TestAuthFileMissing(t *testing.T) {
+	file, err := registry.LoadAuthFile(filepath.Join(t.TempDir(), "auth.json"))
+	if err != nil {
+		t.Fatalf("LoadAuthFile returned an error (%v)", err)
+	}
+	if username, _, err := file.Get("quay.io"); err != nil || len(username) != 0 {
+		t.Fatalf("Get returned %v, %v", username, err)
+	}
+}
+
+func TestAuthFileHelper(t *testing.T) {
+	// A credential helper keeping the credentials in a file per server
+	bin := t.TempDir()
+	store := t.TempDir()
+	helper := `#!/bin/sh
+store=` + store + `
+case "$1" in
+get)
+	read server
+	f="$store/$(echo "$server" | tr / _)"
+	if [ ! -f "$f" ]; then echo "credentials not found in native keychain"; exit 1; fi
+	cat "$f" ;;
+store)
+	cat > "$store/input"
+	server=$(sed 's/.*"ServerURL":"\([^"]*\)".*/\1/' "$store/input")
+	mv "$store/input" "$store/$(echo "$server" | tr / _)" ;;
+erase)
+	read server
+	f="$store/$(echo "$server" | tr / _)"
+	if [ ! -f "$f" ]; then echo "credentials not found in native keychain"; exit 1; fi
+	rm "$f" ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(bin, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	path := filepath.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(path, []byte(`{"credHelpers": {"quay.io": "test"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := registry.LoadAuthFile(path)
+	if err != nil {
+		t.Fatalf("LoadAuthFile returned an error (%v)", err)
+	}
+	if username, _, err := file.Get("quay.io"); err != nil || len(username) != 0 {
+		t.Fatalf("Get before Set returned %v, %v", username, err)
+	}
+	if err := file.Set("quay.io", "user", "secret"); err != nil {
+		t.Fatalf("Set returned an error (%v)", err)
+	}
+	username, password, err := file.Get("quay.io")
+	if err != nil || username != "user" || password != "secret" {
+		t.Fatalf("Get returned %v, %v, %v", username, password, err)
+	}
+	// The credentials are not in the file
+	if err := file.Save(); err != nil {
+		t.Fatalf("Save returned an error (%v)", err)
+	}
+	file, err = registry.LoadAuthFile(path)
+	if err != nil {
+		t.Fatalf("LoadAuthFile returned an error (%v)", err)
+	}
+	if len(file.Auths) != 0 {
+		t.Fatalf("the credentials of the helper are in the file: %v", file.Auths)
+	}
+	if err := file.Remove("quay.io"); err != nil {
+		t.Fatalf("Remove returned an error (%v)", err)
+	}
+	if err := file.Remove("quay.io"); !errors.Is(err, registry.ErrNotLoggedIn) {
+		t.Fatalf("Remove of a missing host returned %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+
+// Package registry is a client of the registries implementing the OCI
+// distribution spec (https://github.com/opencontainers/distribution-spec).
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"rocked/specs"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// The registry of the image names without a domain
+	DEFAULT_REGISTRY = "docker.io"
+	// The host actually serving the images of docker.io
+	DOCKER_HUB_HOST = "registry-1.docker.io"
+	// The media types accepted for the manifests, the preferred first
+	MANIFEST_MEDIA_TYPES = []string{
+		specs.MediaTypeImageIndex,
+		specs.MediaTypeImageManifest,
+		specs.MediaTypeDockerManifestList,
+		specs.MediaTypeDockerManifest,
+	}
+	// The largest manifest accepted (see the distribution spec)
+	MAX_MANIFEST_SIZE int64 = 4 << 20
+)
+
+// Credentials returns the username and password for a registry host.
+// An empty username means no credentials.
+type Credentials func(host string) (username, password string, err error)
+
+// Client talks to the registries.
+// The tokens obtained are cached, for the host and scope they were issued for.
+type Client struct {
+	HTTP *http.Client
+	// Use http instead of https
+	PlainHTTP bool
+	// If set, the credentials for the registries asking for them
+	Credentials Credentials
+	// The size of the chunks of the blobs uploaded, DEFAULT_CHUNK_SIZE if 0
+	ChunkSize int64
+	mu        sync.Mutex
+	tokens    map[string]string
+	// The registries asking for basic authentication
+	basic map[string]bool
+}
+
+func NewClient() *Client {
+	return &Client{HTTP: http.DefaultClient}
+}
+
+// Repository is a repository of a registry
+type Repository struct {
+	client *Client
+	// The registry host, with the port if any
+	Host string
+	// The repository name, e.g. library/fedora
+	Name string
+}
+
+// Returns whether host is docker.io, by any of its names
+func isDockerHub(host string) bool {
+	return len(host) == 0 || host == DEFAULT_REGISTRY || host == "index.docker.io" || host == DOCKER_HUB_HOST
+}
+
+// RegistryHost returns the host serving the registry host, DOCKER_HUB_HOST
+// for docker.io.
+func RegistryHost(host string) string {
+	if isDockerHub(host) {
+		return DOCKER_HUB_HOST
+	}
+	return host
+}
+
+// Repository returns the repository name of the registry host.
+// The docker.io repositories are served by DOCKER_HUB_HOST and the ones
+// without a namespace are in library/, as docker does.
+func (c *Client) Repository(host, name string) *Repository {
+	if isDockerHub(host) && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return &Repository{client: c, Host: RegistryHost(host), Name: name}
+}
+
+// Returns the URL of the API root of host
+func (c *Client) apiURL(host string) string {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/", scheme, host)
+}
+
+func (r *Repository) String() string {
+	return r.Host + "/" + r.Name
+}
+
+// Returns the URL of the path of the repository API, e.g. manifests/latest
+func (r *Repository) url(path string) string {
+	return fmt.Sprintf("%s%s/%s", r.client.apiURL(r.Host), r.Name, path)
+}
+
+// Returns the token scope of the repository for actions, e.g. pull
+func (r *Repository) scope(actions string) string {
+	return fmt.Sprintf("repository:%s:%s", r.Name, actions)
+}
+
+// Error is an error returned by a registry
+type Error struct {
+	StatusCode int
+	Method     string
+	URL        string
+	// The errors of the response body, if any
+	Errors []ErrorDetail `json:"errors"`
+}
+
+// ErrorDetail is an error of a registry response body, e.g. MANIFEST_UNKNOWN
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%s %s: %s", e.Method, e.URL, http.StatusText(e.StatusCode))
+	for _, d := range e.Errors {
+		s += fmt.Sprintf(": %s %s", d.Code, d.Message)
+	}
+	return s
+}
+
+// Returns the error of an unexpected response, closing its body
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode, Method: resp.Request.Method, URL: resp.Request.URL.String()}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(data, e)
+	return e
+}
+
+// IsNotFound tells if err is a registry error for a missing manifest, blob
+// or repository
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Returns the media type of a response, without its parameters
+func contentType(resp *http.Response) string {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// Manifest fetches the manifest or image index reference, a tag or a digest.
+// The content is verified against the digest, when given, and against the
+// Docker-Content-Digest header, when using the same algorithm.
+// It returns the descriptor of the manifest and its content.
+func (r *Repository) Manifest(ctx context.Context, reference string) (specs.Descriptor, []byte, error) {
+	slog.Debug("Repository: Manifest", "repository", r, "reference", reference)
+	resp, err := r.client.do(ctx, r.Host, &request{
+		method: http.MethodGet,
+		url:    r.url("manifests/" + reference),
+		header: http.Header{"Accept": {strings.Join(MANIFEST_MEDIA_TYPES, ", ")}},
+		scopes: []string{r.scope("pull")},
+	})
+	if err != nil {
+		return specs.Descriptor{}, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return specs.Descriptor{}, nil, responseError(resp)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_MANIFEST_SIZE+1))
+	if err != nil {
+		return specs.Descriptor{}, nil, err
+	}
+	if int64(len(data)) > MAX_MANIFEST_SIZE {
+		return specs.Descriptor{}, nil, fmt.Errorf("the manifest %v of %v is larger than %v bytes", reference, r, MAX_MANIFEST_SIZE)
+	}
+	desc := specs.Descriptor{MediaType: contentType(resp), Digest: digest.FromBytes(data), Size: int64(len(data))}
+	expected := []digest.Digest{digest.Digest(resp.Header.Get("Docker-Content-Digest"))}
+	if d, err := digest.Parse(reference); err == nil {
+		expected = append(expected, d)
+	}
+	for _, d := range expected {
+		if d.Validate() != nil || !d.Algorithm().Available() {
+			continue
+		}
+		if d.Algorithm() != desc.Digest.Algorithm() {
+			desc.Digest = d.Algorithm().FromBytes(data)
+		}
+		if desc.Digest != d {
+			return specs.Descriptor{}, nil, fmt.Errorf("the manifest %v of %v does not match the digest %v", reference, r, d)
+		}
+	}
+	// Some registries don't tell the media type, the document does
+	if len(desc.MediaType) == 0 || desc.MediaType == "application/json" {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &versioned)
+		desc.MediaType = versioned.MediaType
+	}
+	return desc, data, nil
+}
+
+// FetchBlob fetches the blob described by desc, from offset.
+// It returns the blob content and the offset it starts at: 0 if the
+// registry doesn't support range requests.
+func (r *Repository) FetchBlob(ctx context.Context, desc specs.Descriptor, offset int64) (io.ReadCloser, int64, error) {
+	slog.Debug("Repository: FetchBlob", "repository", r, "blob", desc.Digest, "offset", offset)
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := r.client.do(ctx, r.Host, &request{
+		method: http.MethodGet,
+		url:    r.url("blobs/" + desc.Digest.String()),
+		header: header,
+		scopes: []string{r.scope("pull")},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp.Body, 0, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("unexpected range %q fetching %v", resp.Header.Get("Content-Range"), desc.Digest)
+		}
+		return resp.Body, offset, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// e.g. the partial content is already whole
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), offset, nil
+	}
+	return nil, 0, responseError(resp)
+}
@@ -0,0 +1,188 @@
+package registry_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rocked/registry"
+	"rocked/registry/registrytest"
+	"rocked/specs"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestRepository(t *testing.T) {
+	tests := []struct {
+		host, name string
+		want       string
+	}{
+		{"", "fedora", "registry-1.docker.io/library/fedora"},
+		{"docker.io", "fedora/fedora", "registry-1.docker.io/fedora/fedora"},
+		{"quay.io", "fedora", "quay.io/fedora"},
+		{"localhost:5000", "a/b/c", "localhost:5000/a/b/c"},
+	}
+	client := registry.NewClient()
+	for _, tt := range tests {
+		if got := client.Repository(tt.host, tt.name).String(); got != tt.want {
+			t.Fatalf("Repository(%q, %q) is %v, want %v", tt.host, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManifestTokenAuth(t *testing.T) {
+	reg := registrytest.New()
+	reg.Username, reg.Password = "user", "secret"
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"` + specs.MediaTypeImageManifest + `"}`)
+	d := reg.AddManifest("test", "v1", specs.MediaTypeImageManifest, manifest)
+	srv := registrytest.NewServer(t, reg)
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	client.Credentials = func(host string) (string, string, error) {
+		if host != registrytest.Host(srv) {
+			t.Fatalf("credentials asked for %v", host)
+		}
+		return "user", "secret", nil
+	}
+	repo := client.Repository(registrytest.Host(srv), "test")
+	for _, reference := range []string{"v1", d.String()} {
+		desc, data, err := repo.Manifest(context.Background(), reference)
+		if err != nil {
+			t.Fatalf("Manifest(%v) returned an error (%v)", reference, err)
+		}
+		if desc.Digest != d || desc.MediaType != specs.MediaTypeImageManifest || string(data) != string(manifest) {
+			t.Fatalf("Manifest(%v) returned %+v", reference, desc)
+		}
+	}
+	// The token is asked once
+	tokens := 0
+	for _, r := range reg.Requests() {
+		if strings.HasPrefix(r, "GET /token") {
+			tokens++
+		}
+	}
+	if tokens != 1 {
+		t.Fatalf("%v tokens were asked, want 1", tokens)
+	}
+}
+
+func TestManifestIdentityToken(t *testing.T) {
+	reg := registrytest.New()
+	reg.Username, reg.Password = "user", "secret"
+	reg.IdentityToken = "refresh"
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"` + specs.MediaTypeImageManifest + `"}`)
+	reg.AddManifest("test", "v1", specs.MediaTypeImageManifest, manifest)
+	srv := registrytest.NewServer(t, reg)
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	client.Credentials = func(host string) (string, string, error) {
+		return registry.IDENTITY_TOKEN_USERNAME, "refresh", nil
+	}
+	repo := client.Repository(registrytest.Host(srv), "test")
+	if _, _, err := repo.Manifest(context.Background(), "v1"); err != nil {
+		t.Fatalf("Manifest returned an error (%v)", err)
+	}
+	client = registry.NewClient()
+	client.HTTP = srv.Client()
+	client.Credentials = func(host string) (string, string, error) {
+		return registry.IDENTITY_TOKEN_USERNAME, "expired", nil
+	}
+	repo = client.Repository(registrytest.Host(srv), "test")
+	if _, _, err := repo.Manifest(context.Background(), "v1"); err == nil {
+		t.Fatalf("Manifest with a wrong identity token returned no error")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	reg := registrytest.New()
+	reg.Username, reg.Password = "user", "secret"
+	srv := registrytest.NewServer(t, reg)
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	host := registrytest.Host(srv)
+	if err := client.Login(context.Background(), host, "user", "secret"); err != nil {
+		t.Fatalf("Login returned an error (%v)", err)
+	}
+	err := client.Login(context.Background(), host, "user", "wrong")
+	var e *registry.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Login with a wrong password returned %v", err)
+	}
+	// The credentials checked are not kept by the client
+	if client.Credentials != nil {
+		t.Fatalf("Login set the credentials of the client")
+	}
+}
+
+func TestManifestDigestMismatch(t *testing.T) {
+	d := digest.FromString("expected")
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+		w.Write([]byte(`{"schemaVersion":2}`))
+	}))
+	defer srv.Close()
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	repo := client.Repository(registrytest.Host(srv), "test")
+	if _, _, err := repo.Manifest(context.Background(), d.String()); err == nil {
+		t.Fatalf("Manifest accepted a content not matching its digest")
+	}
+}
+
+func TestFetchBlobRange(t *testing.T) {
+	reg := registrytest.New()
+	d := reg.AddBlob("test", []byte("0123456789"))
+	srv := registrytest.NewServer(t, reg)
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	repo := client.Repository(registrytest.Host(srv), "test")
+	body, start, err := repo.FetchBlob(context.Background(), specs.Descriptor{Digest: d, Size: 10}, 4)
+	if err != nil {
+		t.Fatalf("FetchBlob returned an error (%v)", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil || start != 4 || string(data) != "456789" {
+		t.Fatalf("FetchBlob returned %q from %v (%v), want 456789 from 4", data, start, err)
+	}
+}
+
+func TestPushBlob(t *testing.T) {
+	reg := registrytest.New()
+	srv := registrytest.NewServer(t, reg)
+	client := registry.NewClient()
+	client.HTTP = srv.Client()
+	repo := client.Repository(registrytest.Host(srv), "test")
+	desc := specs.Descriptor{Digest: digest.FromString("0123456789"), Size: 10}
+	// In chunks, then at once
+	for _, chunkSize := range []int64{3, 0} {
+		client.ChunkSize = chunkSize
+		if err := repo.PushBlob(context.Background(), desc, strings.NewReader("0123456789")); err != nil {
+			t.Fatalf("PushBlob with chunks of %v returned an error (%v)", chunkSize, err)
+		}
+	}
+	if data, ok := reg.Blob("test", digest.FromString("0123456789")); !ok || string(data) != "0123456789" {
+		t.Fatalf("the registry has the blob %q (%v)", data, ok)
+	}
+	exists, err := repo.BlobExists(context.Background(), specs.Descriptor{Digest: digest.FromString("0123456789")})
+	if err != nil || !exists {
+		t.Fatalf("BlobExists returned %v (%v)", exists, err)
+	}
+	wrong := specs.Descriptor{Digest: digest.FromString("something else"), Size: 10}
+	if err := repo.PushBlob(context.Background(), wrong, strings.NewReader("0123456789")); err == nil {
+		t.Fatalf("PushBlob accepted a content not matching its digest")
+	}
+	// The content fails its verification once read
+	corrupted := specs.Descriptor{Digest: digest.FromString("abcdefghij"), Size: 10}
+	content := io.MultiReader(strings.NewReader("abcdefghij"), iotest.ErrReader(errors.New("corrupted")))
+	if err := repo.PushBlob(context.Background(), corrupted, content); err == nil {
+		t.Fatalf("PushBlob of a content failing at its end returned no error")
+	}
+	if _, ok := reg.Blob("test", corrupted.Digest); ok {
+		t.Fatalf("the blob failing at its end was committed")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"rocked/specs"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// The size of the chunks the blobs are uploaded in
+	DEFAULT_CHUNK_SIZE int64 = 64 << 20
+)
+
+// BlobExists tells if the repository has the blob described by desc
+func (r *Repository) BlobExists(ctx context.Context, desc specs.Descriptor) (bool, error) {
+	resp, err := r.client.do(ctx, r.Host, &request{
+		method: http.MethodHead,
+		url:    r.url("blobs/" + desc.Digest.String()),
+		scopes: []string{r.scope("pull,push")},
+	})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, responseError(resp)
+}
+
+// Returns the URL of the Location header of resp, relative to its request
+func location(resp *http.Response) (string, error) {
+	loc, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("%v %v: invalid upload location: %w", resp.Request.Method, resp.Request.URL, err)
+	}
+	return loc.String(), nil
+}
+
+// Returns the upload URL u with the query parameter key set to value
+func withQuery(u, key, value string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Set(key, value)
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// Starts an upload, mounting the blob desc from the repository from if set.
+// It returns whether the blob was mounted and, if not, the upload URL.
+func (r *Repository) startUpload(ctx context.Context, desc specs.Descriptor, from string) (bool, string, error) {
+	u := r.url("blobs/uploads/")
+	scopes := []string{r.scope("pull,push")}
+	if len(from) != 0 {
+		u += "?" + url.Values{"mount": {desc.Digest.String()}, "from": {from}}.Encode()
+		scopes = append(scopes, fmt.Sprintf("repository:%s:pull", from))
+	}
+	resp, err := r.client.do(ctx, r.Host, &request{
+		method:        http.MethodPost,
+		url:           u,
+		body:          func() (io.Reader, error) { return http.NoBody, nil },
+		contentLength: 0,
+		scopes:        scopes,
+	})
+	if err != nil {
+		return false, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		resp.Body.Close()
+		return true, "", nil
+	case http.StatusAccepted:
+		resp.Body.Close()
+		loc, err := location(resp)
+		return false, loc, err
+	}
+	return false, "", responseError(resp)
+}
+
+// MountBlob mounts the blob desc of the repository from, of the same
+// registry, in the repository.
+// It returns false if the registry doesn't mount it, e.g. when it doesn't
+// have it.
+func (r *Repository) MountBlob(ctx context.Context, desc specs.Descriptor, from string) (bool, error) {
+	slog.Debug("Repository: MountBlob", "repository", r, "blob", desc.Digest, "from", from)
+	mounted, loc, err := r.startUpload(ctx, desc, from)
+	if err != nil || mounted {
+		return mounted, err
+	}
+	// Cancel the upload started instead
+	resp, err := r.client.do(ctx, r.Host, &request{method: http.MethodDelete, url: loc, scopes: []string{r.scope("pull,push")}})
+	if err == nil {
+		resp.Body.Close()
+	}
+	return false, nil
+}
+
+// PushBlob uploads the blob desc, whose content is read once from content.
+// The content is sent in chunks of the client ChunkSize, and content is read
+// to its end before the upload is closed: a reader verifying what it reads,
+// failing at the end, keeps a corrupted blob from being committed.
+func (r *Repository) PushBlob(ctx context.Context, desc specs.Descriptor, content io.Reader) error {
+	slog.Debug("Repository: PushBlob", "repository", r, "blob", desc.Digest, "size", desc.Size)
+	_, loc, err := r.startUpload(ctx, desc, "")
+	if err != nil {
+		return err
+	}
+	chunkSize := r.client.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	scopes := []string{r.scope("pull,push")}
+	var offset int64
+	for offset < desc.Size {
+		n := min(chunkSize, desc.Size-offset)
+		start := offset
+		read := false
+		resp, err := r.client.do(ctx, r.Host, &request{
+			method: http.MethodPatch,
+			url:    loc,
+			header: http.Header{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("%d-%d", start, start+n-1)},
+			},
+			body: func() (io.Reader, error) {
+				if read {
+					return nil, fmt.Errorf("the chunk at %v of the blob %v can't be read again", start, desc.Digest)
+				}
+				read = true
+				return io.LimitReader(content, n), nil
+			},
+			contentLength: n,
+			scopes:        scopes,
+		})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			return responseError(resp)
+		}
+		resp.Body.Close()
+		if loc, err = location(resp); err != nil {
+			return err
+		}
+		offset += n
+	}
+	// Reaching the end of content verifies it
+	extra, err := io.Copy(io.Discard, content)
+	if err != nil {
+		return err
+	}
+	if extra != 0 {
+		return fmt.Errorf("the blob %v is larger than %v bytes", desc.Digest, desc.Size)
+	}
+	// The last request closes the upload
+	loc, err = withQuery(loc, "digest", desc.Digest.String())
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.do(ctx, r.Host, &request{
+		method:        http.MethodPut,
+		url:           loc,
+		header:        http.Header{"Content-Type": {"application/octet-stream"}},
+		body:          func() (io.Reader, error) { return http.NoBody, nil },
+		contentLength: 0,
+		scopes:        scopes,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PushManifest uploads the manifest or image index data, of type mediaType,
+// as reference: a tag or its digest.
+// It returns the digest of the manifest.
+func (r *Repository) PushManifest(ctx context.Context, reference, mediaType string, data []byte) (digest.Digest, error) {
+	slog.Debug("Repository: PushManifest", "repository", r, "reference", reference, "mediaType", mediaType)
+	d := digest.FromBytes(data)
+	resp, err := r.client.do(ctx, r.Host, &request{
+		method:        http.MethodPut,
+		url:           r.url("manifests/" + reference),
+		header:        http.Header{"Content-Type": {mediaType}},
+		body:          func() (io.Reader, error) { return bytes.NewReader(data), nil },
+		contentLength: int64(len(data)),
+		scopes:        []string{r.scope("pull,push")},
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", responseError(resp)
+	}
+	resp.Body.Close()
+	if got := digest.Digest(resp.Header.Get("Docker-Content-Digest")); got.Validate() == nil && got.Algorithm() == d.Algorithm() && got != d {
+		return "", fmt.Errorf("the registry stored the manifest %v as %v", d, got)
+	}
+	return d, nil
+}
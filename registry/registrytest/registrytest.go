@@ -0,0 +1,387 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+
+// Package registrytest is an in-memory registry stand-in for the tests.
+package registrytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rocked/specs"
+	"rocked/specs/layout"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const TOKEN = "registrytest-token"
+
+type manifest struct {
+	mediaType string
+	data      []byte
+}
+
+// Registry serves the manifests and blobs it holds as an OCI distribution
+// spec registry.
+type Registry struct {
+	// If set, the clients authenticate with a bearer token obtained from
+	// /token with these credentials
+	Username string
+	Password string
+	// If set, the clients may also exchange this OAuth2 refresh token for
+	// the bearer token
+	IdentityToken string
+	// If set, the first response for every blob is cut after FailAfter bytes
+	FailAfter int64
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	// The blobs of every repository
+	repoBlobs map[string]map[digest.Digest]bool
+	// By repository, then by tag and digest
+	manifests map[string]map[string]manifest
+	failed    map[digest.Digest]bool
+	// The content of the uploads in progress, by id
+	uploads map[string]*bytes.Buffer
+	// The number of uploads started, giving their id
+	uploadCount int
+	// The requests received, as "METHOD path [range]"
+	requests []string
+}
+
+func New() *Registry {
+	return &Registry{
+		blobs:     map[digest.Digest][]byte{},
+		repoBlobs: map[string]map[digest.Digest]bool{},
+		manifests: map[string]map[string]manifest{},
+		failed:    map[digest.Digest]bool{},
+		uploads:   map[string]*bytes.Buffer{},
+	}
+}
+
+// NewServer starts a TLS server for r, stopped at the end of the test.
+// The client of the server trusts its certificate.
+func NewServer(t testing.TB, r *Registry) *httptest.Server {
+	srv := httptest.NewTLSServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Host returns the host of the server, to use in the image references
+func Host(srv *httptest.Server) string {
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+// Requests returns the requests received so far
+func (r *Registry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.requests...)
+}
+
+// AddBlob adds data as a blob of repo and returns its digest
+func (r *Registry) AddBlob(repo string, data []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := digest.FromBytes(data)
+	r.addBlob(repo, d, data)
+	return d
+}
+
+func (r *Registry) addBlob(repo string, d digest.Digest, data []byte) {
+	r.blobs[d] = data
+	if r.repoBlobs[repo] == nil {
+		r.repoBlobs[repo] = map[digest.Digest]bool{}
+	}
+	r.repoBlobs[repo][d] = true
+}
+
+// Blob returns the blob of repo with digest d, if any
+func (r *Registry) Blob(repo string, d digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.repoBlobs[repo][d] {
+		return nil, false
+	}
+	return r.blobs[d], true
+}
+
+// AddManifest adds data as a manifest of repo, by digest and, if set, by tag.
+// It returns the manifest digest.
+func (r *Registry) AddManifest(repo, tag, mediaType string, data []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := digest.FromBytes(data)
+	if r.manifests[repo] == nil {
+		r.manifests[repo] = map[string]manifest{}
+	}
+	m := manifest{mediaType: mediaType, data: data}
+	r.manifests[repo][d.String()] = m
+	if len(tag) != 0 {
+		r.manifests[repo][tag] = m
+	}
+	return d
+}
+
+// Manifest returns the manifest of repo tagged or with the digest reference
+func (r *Registry) Manifest(repo, reference string) (string, []byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.manifests[repo][reference]
+	return m.mediaType, m.data, ok
+}
+
+// LoadLayout adds the images of the OCI image layout dir to repo.
+// All the blobs are added, the manifests and indexes by digest and the ones
+// of the layout index by the tag of their ref name annotation.
+func (r *Registry) LoadLayout(repo, dir string) error {
+	err := filepath.Walk(filepath.Join(dir, specs.ImageBlobsDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		r.AddBlob(repo, data)
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		if json.Unmarshal(data, &versioned) == nil && (specs.IsImageManifest(versioned.MediaType) || specs.IsImageIndex(versioned.MediaType)) {
+			r.AddManifest(repo, "", versioned.MediaType, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	index, err := (&layout.Layout{Path: dir}).ReadIndex()
+	if err != nil {
+		return err
+	}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[specs.AnnotationRefName]
+		tag := name[strings.LastIndex(name, ":")+1:]
+		if len(tag) == 0 {
+			continue
+		}
+		data, ok := r.Blob(repo, desc.Digest)
+		if !ok {
+			return fmt.Errorf("the manifest %v is missing", desc.Digest)
+		}
+		r.AddManifest(repo, tag, desc.MediaType, data)
+	}
+	return nil
+}
+
+// Writes an error response of the distribution spec
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// Checks the authentication of req, asking for it if missing
+func (r *Registry) authorized(w http.ResponseWriter, req *http.Request, scope string) bool {
+	if len(r.Username) == 0 || req.Header.Get("Authorization") == "Bearer "+TOKEN {
+		return true
+	}
+	scheme := "https"
+	if req.TLS == nil {
+		scheme = "http"
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s://%s/token",service="registrytest",scope="%s"`, scheme, req.Host, scope))
+	writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+// Serves the token endpoint
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		if len(r.IdentityToken) == 0 || req.PostFormValue("grant_type") != "refresh_token" || req.PostFormValue("refresh_token") != r.IdentityToken {
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid refresh token")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": TOKEN})
+		return
+	}
+	username, password, ok := req.BasicAuth()
+	if !ok || username != r.Username || password != r.Password {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": TOKEN})
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, strings.TrimSpace(req.Method+" "+req.URL.Path+" "+req.Header.Get("Range")+req.Header.Get("Content-Range")))
+	r.mu.Unlock()
+	path := req.URL.Path
+	if path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if !strings.HasPrefix(path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+	if len(path) == 0 {
+		if r.authorized(w, req, "") {
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+	for _, kind := range []string{"/manifests/", "/blobs/uploads/", "/blobs/"} {
+		i := strings.LastIndex(path, kind)
+		if i < 0 {
+			continue
+		}
+		repo, reference := path[:i], path[i+len(kind):]
+		if !r.authorized(w, req, fmt.Sprintf("repository:%s:pull", repo)) {
+			return
+		}
+		switch kind {
+		case "/manifests/":
+			r.serveManifest(w, req, repo, reference)
+		case "/blobs/uploads/":
+			r.serveUpload(w, req, repo, reference)
+		default:
+			r.serveBlob(w, req, repo, digest.Digest(reference))
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown path "+req.URL.Path)
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo, reference string) {
+	if req.Method == http.MethodPut {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		d := digest.FromBytes(data)
+		tag := reference
+		if parsed, err := digest.Parse(reference); err == nil {
+			if parsed != d {
+				writeError(w, http.StatusBadRequest, "DIGEST_INVALID", reference)
+				return
+			}
+			tag = ""
+		}
+		r.AddManifest(repo, tag, req.Header.Get("Content-Type"), data)
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repo, d))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", req.Method)
+		return
+	}
+	mediaType, data, ok := r.Manifest(repo, reference)
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", reference)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, repo string, d digest.Digest) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", req.Method)
+		return
+	}
+	data, ok := r.Blob(repo, d)
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", d.String())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", d.String())
+	r.mu.Lock()
+	fail := req.Method == http.MethodGet && r.FailAfter > 0 && int64(len(data)) > r.FailAfter && !r.failed[d]
+	r.failed[d] = r.failed[d] || fail
+	r.mu.Unlock()
+	if fail {
+		// The connection is closed before the whole content is sent
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data[:r.FailAfter])
+		return
+	}
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+// Serves the blob uploads: POST starts one, or mounts a blob, PATCH appends
+// a chunk, PUT completes one and DELETE cancels it
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.Method == http.MethodPost {
+		query := req.URL.Query()
+		if mount := digest.Digest(query.Get("mount")); len(mount) != 0 {
+			if r.repoBlobs[query.Get("from")][mount] {
+				r.addBlob(repo, mount, r.blobs[mount])
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, mount))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.uploadCount++
+		id = fmt.Sprint(r.uploadCount)
+		r.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	upload, ok := r.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", id)
+		return
+	}
+	switch req.Method {
+	case http.MethodPatch:
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != upload.Len() {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		io.Copy(upload, req.Body)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", upload.Len()-1))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		io.Copy(upload, req.Body)
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if d.Validate() != nil || digest.FromBytes(upload.Bytes()) != d {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", d.String())
+			return
+		}
+		delete(r.uploads, id)
+		r.addBlob(repo, d, upload.Bytes())
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, d))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", req.Method)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"rocked/cmd"
 
 	"os"
+	"syscall"
 	"testing"
 )
 
@@ -15,9 +16,55 @@ func TestForkSuccess(t *testing.T) {
 	if pid < 0 {
 		t.Fatalf("ForkExec didn't return a valid pid (%v)", pid)
 	}
-	p := cmd.Wait(int(pid))
-	if p != int(pid) {
-		t.Fatalf("Wait failed (returned pid (%v) is different from the passed pid (%v)", p, pid)
+	ws, err := cmd.Wait(int(pid))
+	if err != 0 {
+		t.Fatalf("Wait failed with an error (%v)", err)
+	}
+	if ws.Pid != int(pid) {
+		t.Fatalf("Wait failed (returned pid (%v) is different from the passed pid (%v)", ws.Pid, pid)
+	}
+}
+
+func TestWaitExitStatus(t *testing.T) {
+	tests := []struct {
+		script     string
+		exitCode   int
+		signal     syscall.Signal
+		exitStatus int
+	}{
+		{"exit 0", 0, 0, 0},
+		{"exit 3", 3, 0, 3},
+		{"kill -KILL $$", 0, syscall.SIGKILL, 137},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			p, err := os.StartProcess("/bin/sh", []string{"/bin/sh", "-c", tt.script}, &os.ProcAttr{})
+			if err != nil {
+				t.Fatalf("Error starting the process (%v)", err)
+			}
+			ws, errno := cmd.Wait(p.Pid)
+			if errno != 0 {
+				t.Fatalf("Wait failed with an error (%v)", errno)
+			}
+			if ws.Pid != p.Pid || ws.ExitCode != tt.exitCode || ws.Signal != tt.signal || ws.ExitStatus() != tt.exitStatus {
+				t.Errorf("got %+v (exit status %v) want exit code %v signal %v exit status %v", ws, ws.ExitStatus(), tt.exitCode, tt.signal, tt.exitStatus)
+			}
+		})
+	}
+}
+
+func TestSetns(t *testing.T) {
+	fd, err := syscall.Open("/proc/self/ns/uts", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Error opening the uts namespace (%v)", err)
+	}
+	defer syscall.Close(fd)
+	// Joining our own namespace is allowed, joining it as another type is not
+	if errno := cmd.Setns(fd, cmd.CLONE_NEWUTS); errno != 0 {
+		t.Fatalf("Error joining the uts namespace (%v)", errno)
+	}
+	if errno := cmd.Setns(fd, cmd.CLONE_NEWNET); errno != syscall.EINVAL {
+		t.Fatalf("got %v joining the uts namespace as a net one want %v", errno, syscall.EINVAL)
 	}
 }
 
@@ -0,0 +1,56 @@
+package specs
+
+// The media types of the Docker image manifest v2, schema 2, which most
+// registries still serve. Their documents have the same structure as the OCI
+// ones.
+const (
+	// MediaTypeDockerManifestList is the media type of a Docker manifest list,
+	// the equivalent of an image index.
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// MediaTypeDockerManifest is the media type of a Docker image manifest.
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// MediaTypeDockerConfig is the media type of a Docker image configuration.
+	MediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+
+	// MediaTypeDockerLayer is the media type of an uncompressed Docker layer.
+	MediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar"
+
+	// MediaTypeDockerLayerGzip is the media type of a gzipped Docker layer.
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeDockerForeignLayerGzip is the media type of a gzipped Docker
+	// layer with distribution restrictions.
+	MediaTypeDockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// IsImageIndex tells if mediaType is the one of an image index or Docker
+// manifest list
+func IsImageIndex(mediaType string) bool {
+	return mediaType == MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// IsImageManifest tells if mediaType is the one of an OCI or Docker image
+// manifest
+func IsImageManifest(mediaType string) bool {
+	return mediaType == MediaTypeImageManifest || mediaType == MediaTypeDockerManifest
+}
+
+// IsImageConfig tells if mediaType is the one of an OCI or Docker image
+// configuration
+func IsImageConfig(mediaType string) bool {
+	return mediaType == MediaTypeImageConfig || mediaType == MediaTypeDockerConfig
+}
+
+// IsImageLayer tells if mediaType is the one of an OCI or Docker image
+// layer, compressed or not
+func IsImageLayer(mediaType string) bool {
+	switch mediaType {
+	case MediaTypeImageLayer, MediaTypeImageLayerGzip, MediaTypeImageLayerZstd,
+		MediaTypeImageLayerNonDistributable, MediaTypeImageLayerNonDistributableGzip, MediaTypeImageLayerNonDistributableZstd,
+		MediaTypeDockerLayer, MediaTypeDockerLayerGzip, MediaTypeDockerForeignLayerGzip:
+		return true
+	}
+	return false
+}
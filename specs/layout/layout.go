@@ -0,0 +1,282 @@
+/*
+Copyright © 2024 Pierguido Lambri <plambri@redhat.com>
+*/
+
+// Package layout writes OCI image layouts
+// (https://github.com/opencontainers/image-spec/blob/main/image-layout.md):
+// the oci-layout file, the blobs by digest and the index.json naming the
+// manifests with the org.opencontainers.image.ref.name annotation.
+package layout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"rocked/specs"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DigestError is returned when the content of a blob does not match its
+// digest
+type DigestError struct {
+	Want digest.Digest
+	Got  digest.Digest
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("blob content is %v, want %v", e.Got, e.Want)
+}
+
+// Layout is an OCI image layout directory
+type Layout struct {
+	Path string
+}
+
+// Create creates the image layout in dir, with an empty index, or opens it
+// if it exists.
+func Create(dir string) (*Layout, error) {
+	slog.Debug("layout: Create", "dir", dir)
+	if err := os.MkdirAll(filepath.Join(dir, specs.ImageBlobsDir), 0755); err != nil {
+		return nil, err
+	}
+	l := &Layout{Path: dir}
+	if _, err := os.Stat(filepath.Join(dir, specs.ImageLayoutFile)); os.IsNotExist(err) {
+		data, err := Marshal(specs.ImageLayout{Version: specs.ImageLayoutVersion})
+		if err != nil {
+			return nil, err
+		}
+		if err := WriteFileAtomic(filepath.Join(dir, specs.ImageLayoutFile), data, 0644); err != nil {
+			return nil, err
+		}
+	} else if err := Check(dir); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(l.indexPath()); os.IsNotExist(err) {
+		if err := l.WriteIndex(NewIndex()); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Open opens the existing image layout in dir
+func Open(dir string) (*Layout, error) {
+	if err := Check(dir); err != nil {
+		return nil, err
+	}
+	return &Layout{Path: dir}, nil
+}
+
+// Check checks the oci-layout file of the image layout in dir
+func Check(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, specs.ImageLayoutFile))
+	if err != nil {
+		return err
+	}
+	var layout specs.ImageLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return fmt.Errorf("invalid %v: %w", specs.ImageLayoutFile, err)
+	}
+	if layout.Version != specs.ImageLayoutVersion {
+		return fmt.Errorf("unsupported image layout version %q", layout.Version)
+	}
+	return nil
+}
+
+// NewIndex returns an empty image index
+func NewIndex() specs.Index {
+	return specs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: specs.MediaTypeImageIndex,
+		Manifests: []specs.Descriptor{},
+	}
+}
+
+// BlobName returns the path of the blob with digest d in an image layout,
+// e.g. blobs/sha256/<hex>
+func BlobName(d digest.Digest) string {
+	return path.Join(specs.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+}
+
+// BlobPath returns the location of the blob with digest d
+func (l *Layout) BlobPath(d digest.Digest) string {
+	return filepath.Join(l.Path, filepath.FromSlash(BlobName(d)))
+}
+
+func (l *Layout) HasBlob(d digest.Digest) bool {
+	_, err := os.Stat(l.BlobPath(d))
+	return err == nil
+}
+
+// WriteBlob stores the content of r as the blob with digest d.
+// The content is verified before being moved in place, so the layout never
+// holds a blob not matching its digest: a *DigestError is returned instead.
+func (l *Layout) WriteBlob(r io.Reader, d digest.Digest) error {
+	slog.Debug("Layout: WriteBlob", "digest", d)
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if l.HasBlob(d) {
+		return nil
+	}
+	blobPath := l.BlobPath(d)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	digester := d.Algorithm().Digester()
+	_, err = io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	if errc := tmp.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	if got := digester.Digest(); got != d {
+		return &DigestError{Want: d, Got: got}
+	}
+	return os.Rename(tmp.Name(), blobPath)
+}
+
+// WriteJSONBlob stores v, in canonical JSON, as a blob.
+// It returns the descriptor of the blob, of type mediaType.
+func (l *Layout) WriteJSONBlob(mediaType string, v any) (specs.Descriptor, error) {
+	data, err := Marshal(v)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	desc := specs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err := l.WriteBlob(bytes.NewReader(data), desc.Digest); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (l *Layout) indexPath() string {
+	return filepath.Join(l.Path, specs.ImageIndexFile)
+}
+
+func (l *Layout) ReadIndex() (specs.Index, error) {
+	var index specs.Index
+	data, err := os.ReadFile(l.indexPath())
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+// WriteIndex replaces the index of the layout
+func (l *Layout) WriteIndex(index specs.Index) error {
+	data, err := Marshal(index)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(l.indexPath(), data, 0644)
+}
+
+// Tag adds the manifest desc to the index of the layout with the name ref
+// (see AddManifest).
+// The index is read and written back: concurrent updates have to be
+// serialised by the caller.
+func (l *Layout) Tag(desc specs.Descriptor, ref string) error {
+	slog.Debug("Layout: Tag", "manifest", desc.Digest, "ref", ref)
+	index, err := l.ReadIndex()
+	if err != nil {
+		return err
+	}
+	AddManifest(&index, desc, ref)
+	return l.WriteIndex(index)
+}
+
+// AddManifest adds the manifest desc to index, named ref with the
+// org.opencontainers.image.ref.name annotation.
+// A manifest previously named ref loses the name, and the entry of desc
+// without a name is replaced.
+// With an empty ref, the manifest is added without a name, unless it's
+// already in the index.
+func AddManifest(index *specs.Index, desc specs.Descriptor, ref string) {
+	if len(ref) == 0 {
+		for _, m := range index.Manifests {
+			if m.Digest == desc.Digest {
+				return
+			}
+		}
+		index.Manifests = append(index.Manifests, desc)
+		return
+	}
+	manifests := []specs.Descriptor{}
+	for _, m := range index.Manifests {
+		name := m.Annotations[specs.AnnotationRefName]
+		if name == ref || (len(name) == 0 && m.Digest == desc.Digest) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	tagged := desc
+	tagged.Annotations = map[string]string{}
+	for k, v := range desc.Annotations {
+		tagged.Annotations[k] = v
+	}
+	tagged.Annotations[specs.AnnotationRefName] = ref
+	index.Manifests = append(manifests, tagged)
+}
+
+// Marshal returns the canonical JSON encoding of v: compact, with the keys
+// of the objects sorted and without escaping <, > and &, so the same
+// document always has the same digest.
+func Marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Decoded generically, the struct fields are sorted like the map keys
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// WriteFileAtomic writes data to the file name, replacing it in a single
+// step so readers never see a partial file
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if errc := tmp.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,133 @@
+package layout_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"rocked/specs"
+	"rocked/specs/layout"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCreate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "layout")
+	l, err := layout.Create(dir)
+	if err != nil {
+		t.Fatalf("Create returned an error (%v)", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, specs.ImageLayoutFile))
+	if err != nil || string(data) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Fatalf("the oci-layout file is %s (%v)", data, err)
+	}
+	index, err := l.ReadIndex()
+	if err != nil {
+		t.Fatalf("ReadIndex returned an error (%v)", err)
+	}
+	if index.SchemaVersion != 2 || index.MediaType != specs.MediaTypeImageIndex || len(index.Manifests) != 0 {
+		t.Fatalf("the new index is %+v", index)
+	}
+	if _, err := layout.Open(dir); err != nil {
+		t.Fatalf("Open returned an error (%v)", err)
+	}
+	// An existing layout is kept
+	if err := l.Tag(specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: digest.FromString("a"), Size: 1}, "a:latest"); err != nil {
+		t.Fatalf("Tag returned an error (%v)", err)
+	}
+	if l, err = layout.Create(dir); err != nil {
+		t.Fatalf("Create of an existing layout returned an error (%v)", err)
+	}
+	if index, _ := l.ReadIndex(); len(index.Manifests) != 1 {
+		t.Fatalf("Create reset the index: %+v", index)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, specs.ImageLayoutFile), []byte(`{"imageLayoutVersion":"2.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := layout.Create(dir); err == nil {
+		t.Fatalf("Create accepted an unsupported layout version")
+	}
+	if _, err := layout.Open(t.TempDir()); err == nil {
+		t.Fatalf("Open accepted a directory without an image layout")
+	}
+}
+
+func TestWriteBlob(t *testing.T) {
+	l, err := layout.Create(t.TempDir())
+	if err != nil {
+		t.Fatalf("Create returned an error (%v)", err)
+	}
+	d := digest.FromString("content")
+	if err := l.WriteBlob(strings.NewReader("content"), d); err != nil {
+		t.Fatalf("WriteBlob returned an error (%v)", err)
+	}
+	if want := filepath.Join(l.Path, "blobs", "sha256", d.Encoded()); l.BlobPath(d) != want {
+		t.Fatalf("BlobPath is %v, want %v", l.BlobPath(d), want)
+	}
+	if data, err := os.ReadFile(l.BlobPath(d)); err != nil || string(data) != "content" {
+		t.Fatalf("the blob is %q (%v)", data, err)
+	}
+
+	wrong := digest.FromString("other")
+	err = l.WriteBlob(strings.NewReader("content"), wrong)
+	var mismatch *layout.DigestError
+	if !errors.As(err, &mismatch) || mismatch.Want != wrong || mismatch.Got != d {
+		t.Fatalf("WriteBlob of a wrong content returned %v, want DigestError", err)
+	}
+	if l.HasBlob(wrong) {
+		t.Fatalf("the wrong content was stored")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(l.BlobPath(d)))
+	if len(entries) != 1 {
+		t.Fatalf("the blobs directory has %v entries, want 1", len(entries))
+	}
+	if err := l.WriteBlob(strings.NewReader("content"), "sha256:nothex"); err == nil {
+		t.Fatalf("WriteBlob accepted an invalid digest")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	v := struct {
+		Zeta  string            `json:"zeta"`
+		Alpha map[string]string `json:"alpha"`
+		Size  int64             `json:"size"`
+	}{"<a&b>", map[string]string{"b": "2", "a": "1"}, 1 << 53}
+	data, err := layout.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal returned an error (%v)", err)
+	}
+	want := `{"alpha":{"a":"1","b":"2"},"size":9007199254740992,"zeta":"<a&b>"}`
+	if string(data) != want {
+		t.Fatalf("Marshal returned %s, want %s", data, want)
+	}
+}
+
+func TestAddManifest(t *testing.T) {
+	a := specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: digest.FromString("a"), Size: 1}
+	b := specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: digest.FromString("b"), Size: 1}
+	index := layout.NewIndex()
+	names := func() []string {
+		var names []string
+		for _, m := range index.Manifests {
+			names = append(names, m.Digest.Encoded()[:4]+"="+m.Annotations[specs.AnnotationRefName])
+		}
+		return names
+	}
+	layout.AddManifest(&index, a, "")
+	layout.AddManifest(&index, a, "")
+	layout.AddManifest(&index, b, "test:v1")
+	if got := strings.Join(names(), " "); got != "ca97= 3e23=test:v1" {
+		t.Fatalf("the index manifests are %v", got)
+	}
+	// The name moves to a, whose unnamed entry is replaced
+	layout.AddManifest(&index, a, "test:v1")
+	layout.AddManifest(&index, a, "test:v2")
+	if got := strings.Join(names(), " "); got != "ca97=test:v1 ca97=test:v2" {
+		t.Fatalf("the index manifests are %v", got)
+	}
+	if a.Annotations != nil {
+		t.Fatalf("AddManifest changed the annotations of the descriptor")
+	}
+}
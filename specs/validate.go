@@ -0,0 +1,401 @@
+package specs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+var (
+	// The media types grammar of RFC 6838, section 4.2
+	mediaTypeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+	// The org.opencontainers.image.ref.name grammar of the image layout
+	refNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]+(?:(?:[-._:@+]|--)[A-Za-z0-9]+)*(?:/[A-Za-z0-9]+(?:(?:[-._:@+]|--)[A-Za-z0-9]+)*)*$`)
+	// The exposed ports of an image config, e.g. 80/tcp
+	exposedPortRegexp = regexp.MustCompile(`^[0-9]+(?:/(?:tcp|udp|sctp))?$`)
+	// The pre-defined annotation keys, the only ones of their namespace
+	annotationKeys = []string{
+		AnnotationCreated, AnnotationAuthors, AnnotationURL, AnnotationDocumentation,
+		AnnotationSource, AnnotationVersion, AnnotationRevision, AnnotationVendor,
+		AnnotationLicenses, AnnotationRefName, AnnotationTitle, AnnotationDescription,
+		AnnotationBaseImageDigest, AnnotationBaseImageName,
+	}
+)
+
+// Violation is a rule of the image spec broken by a document
+type Violation struct {
+	// The JSON path of the value breaking the rule, e.g. $.layers[0].digest
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// The violations found so far
+type violations []Violation
+
+func (v *violations) add(path, format string, args ...any) {
+	*v = append(*v, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Returns the path of the key of the object at path, e.g. $.annotations["a.b"]
+func keyPath(path, key string) string {
+	return fmt.Sprintf("%s[%q]", path, key)
+}
+
+// Returns the path of the element i of the array at path
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+// Returns the keys of m, sorted so the violations come in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (v *violations) schemaVersion(version int) {
+	if version != 2 {
+		v.add("$.schemaVersion", "must be 2, not %d", version)
+	}
+}
+
+// Checks that the mediaType of a document is want
+func (v *violations) documentMediaType(mediaType, want string, required bool) {
+	if len(mediaType) == 0 {
+		if required {
+			v.add("$.mediaType", "is required and must be %v", want)
+		}
+		return
+	}
+	if mediaType != want {
+		v.add("$.mediaType", "is %v, must be %v", mediaType, want)
+	}
+}
+
+func (v *violations) mediaType(path, mediaType string) {
+	if len(mediaType) == 0 {
+		v.add(path, "is required")
+	} else if !mediaTypeRegexp.MatchString(mediaType) {
+		v.add(path, "%q is not a valid media type (RFC 6838)", mediaType)
+	}
+}
+
+func (v *violations) digest(path string, d digest.Digest) {
+	if len(d) == 0 {
+		v.add(path, "is required")
+		return
+	}
+	err := d.Validate()
+	switch {
+	case errors.Is(err, digest.ErrDigestUnsupported):
+		v.add(path, "unsupported digest algorithm %q", d.Algorithm())
+	case err != nil:
+		v.add(path, "%q is not a valid digest: %v", d, err)
+	}
+}
+
+func (v *violations) url(path, value string) {
+	if u, err := url.Parse(value); err != nil || !u.IsAbs() {
+		v.add(path, "%q is not an absolute URL (RFC 3986)", value)
+	}
+}
+
+func (v *violations) rfc3339(path, value string) {
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		v.add(path, "%q is not an RFC 3339 date and time", value)
+	}
+}
+
+func (v *violations) platform(path string, p *Platform) {
+	if p == nil {
+		return
+	}
+	if len(p.Architecture) == 0 {
+		v.add(path+".architecture", "is required")
+	}
+	if len(p.OS) == 0 {
+		v.add(path+".os", "is required")
+	}
+}
+
+func (v *violations) annotations(path string, annotations map[string]string) {
+	path += ".annotations"
+	for _, key := range sortedKeys(annotations) {
+		value := annotations[key]
+		p := keyPath(path, key)
+		switch key {
+		case "":
+			v.add(path, "an annotation key can't be empty")
+		case AnnotationCreated:
+			v.rfc3339(p, value)
+		case AnnotationURL, AnnotationDocumentation, AnnotationSource:
+			v.url(p, value)
+		case AnnotationBaseImageDigest:
+			v.digest(p, digest.Digest(value))
+		case AnnotationRefName:
+			if !refNameRegexp.MatchString(value) {
+				v.add(p, "%q is not a valid reference name", value)
+			}
+		default:
+			if strings.HasPrefix(key, "org.opencontainers.image.") && !slices.Contains(annotationKeys, key) {
+				v.add(p, "unknown key of the reserved org.opencontainers.image namespace")
+			}
+		}
+	}
+}
+
+func (v *violations) descriptor(path string, desc Descriptor) {
+	v.mediaType(path+".mediaType", desc.MediaType)
+	v.digest(path+".digest", desc.Digest)
+	if desc.Size < 0 {
+		v.add(path+".size", "must not be negative, not %d", desc.Size)
+	}
+	for i, u := range desc.URLs {
+		v.url(indexPath(path+".urls", i), u)
+	}
+	v.annotations(path, desc.Annotations)
+	if desc.Data != nil {
+		if int64(len(desc.Data)) != desc.Size {
+			v.add(path+".data", "is %d bytes, the size is %d", len(desc.Data), desc.Size)
+		} else if desc.Digest.Validate() == nil && desc.Digest.Algorithm().FromBytes(desc.Data) != desc.Digest {
+			v.add(path+".data", "does not match the digest")
+		}
+	}
+	v.platform(path+".platform", desc.Platform)
+	if len(desc.ArtifactType) != 0 {
+		v.mediaType(path+".artifactType", desc.ArtifactType)
+	}
+}
+
+// ValidateDescriptor returns the rules of the image spec broken by desc
+func ValidateDescriptor(desc Descriptor) []Violation {
+	var v violations
+	v.descriptor("$", desc)
+	return v
+}
+
+// Checks the manifest m, of type mediaType
+func (v *violations) manifest(m Manifest, mediaType string) {
+	v.schemaVersion(m.SchemaVersion)
+	v.documentMediaType(m.MediaType, mediaType, mediaType != MediaTypeImageManifest)
+	if len(m.ArtifactType) != 0 {
+		v.mediaType("$.artifactType", m.ArtifactType)
+	}
+	v.descriptor("$.config", m.Config)
+	if m.Config.MediaType == MediaTypeEmptyJSON && len(m.ArtifactType) == 0 {
+		v.add("$.artifactType", "is required with an empty config")
+	}
+	image := IsImageConfig(m.Config.MediaType)
+	switch {
+	case m.Layers == nil:
+		v.add("$.layers", "is required")
+	case len(m.Layers) == 0 && image:
+		v.add("$.layers", "an image needs at least one layer")
+	}
+	for i, layer := range m.Layers {
+		path := indexPath("$.layers", i)
+		v.descriptor(path, layer)
+		if image && len(layer.MediaType) != 0 && !IsImageLayer(layer.MediaType) {
+			v.add(path+".mediaType", "%v is not a layer media type", layer.MediaType)
+		}
+	}
+	if m.Subject != nil {
+		v.descriptor("$.subject", *m.Subject)
+	}
+	v.annotations("$", m.Annotations)
+}
+
+// ValidateManifest returns the rules of the image spec broken by the image
+// manifest m
+func ValidateManifest(m Manifest) []Violation {
+	var v violations
+	v.manifest(m, MediaTypeImageManifest)
+	return v
+}
+
+// Checks the image index, of type mediaType
+func (v *violations) index(index Index, mediaType string) {
+	v.schemaVersion(index.SchemaVersion)
+	v.documentMediaType(index.MediaType, mediaType, mediaType != MediaTypeImageIndex)
+	if len(index.ArtifactType) != 0 {
+		v.mediaType("$.artifactType", index.ArtifactType)
+	}
+	if index.Manifests == nil {
+		v.add("$.manifests", "is required")
+	}
+	for i, m := range index.Manifests {
+		v.descriptor(indexPath("$.manifests", i), m)
+	}
+	if index.Subject != nil {
+		v.descriptor("$.subject", *index.Subject)
+	}
+	v.annotations("$", index.Annotations)
+}
+
+// ValidateIndex returns the rules of the image spec broken by the image
+// index
+func ValidateIndex(index Index) []Violation {
+	var v violations
+	v.index(index, MediaTypeImageIndex)
+	return v
+}
+
+func (v *violations) image(image Image) {
+	v.platform("$", &image.Platform)
+	if image.RootFS.Type != "layers" {
+		v.add("$.rootfs.type", "must be layers, not %q", image.RootFS.Type)
+	}
+	if image.RootFS.DiffIDs == nil {
+		v.add("$.rootfs.diff_ids", "is required")
+	}
+	for i, d := range image.RootFS.DiffIDs {
+		v.digest(indexPath("$.rootfs.diff_ids", i), d)
+	}
+	if len(image.History) != 0 {
+		layers := 0
+		for _, h := range image.History {
+			if !h.EmptyLayer {
+				layers++
+			}
+		}
+		if layers != len(image.RootFS.DiffIDs) {
+			v.add("$.history", "has %d entries with a layer for %d diff IDs", layers, len(image.RootFS.DiffIDs))
+		}
+	}
+	for i, env := range image.Config.Env {
+		if name, _, ok := strings.Cut(env, "="); !ok || len(name) == 0 {
+			v.add(indexPath("$.config.Env", i), "%q is not in the NAME=value format", env)
+		}
+	}
+	for _, port := range sortedKeys(image.Config.ExposedPorts) {
+		if !exposedPortRegexp.MatchString(port) {
+			v.add(keyPath("$.config.ExposedPorts", port), "%q is not a port with an optional tcp, udp or sctp protocol", port)
+		}
+	}
+}
+
+// ValidateImage returns the rules of the image spec broken by the image
+// configuration
+func ValidateImage(image Image) []Violation {
+	var v violations
+	v.image(image)
+	return v
+}
+
+// An image configuration with its dates as written, to check their format
+type rawImage struct {
+	Image
+	Created *string      `json:"created,omitempty"`
+	History []rawHistory `json:"history,omitempty"`
+}
+
+type rawHistory struct {
+	History
+	Created *string `json:"created,omitempty"`
+}
+
+// Adds the violation of the JSON decoding error err
+func (v *violations) decoding(err error) {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr) && len(typeErr.Field) != 0:
+		v.add("$."+typeErr.Field, "must be a JSON %v, not %v", typeErr.Type.Kind(), typeErr.Value)
+	case errors.As(err, &typeErr):
+		v.add("$", "must be a JSON %v, not %v", typeErr.Type.Kind(), typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		v.add("$", "invalid JSON at offset %d: %v", syntaxErr.Offset, err)
+	default:
+		v.add("$", "invalid JSON: %v", err)
+	}
+}
+
+// Validate returns the rules of the image spec broken by the JSON document
+// data, of type mediaType: an image index, manifest or configuration, OCI or
+// Docker.
+func Validate(mediaType string, data []byte) []Violation {
+	var v violations
+	switch {
+	case IsImageIndex(mediaType):
+		var index Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			v.decoding(err)
+			return v
+		}
+		v.index(index, mediaType)
+	case IsImageManifest(mediaType):
+		var manifest Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			v.decoding(err)
+			return v
+		}
+		v.manifest(manifest, mediaType)
+	case IsImageConfig(mediaType):
+		var raw rawImage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			v.decoding(err)
+			return v
+		}
+		image := raw.Image
+		if raw.Created != nil {
+			v.rfc3339("$.created", *raw.Created)
+		}
+		image.History = nil
+		for i, h := range raw.History {
+			if h.Created != nil {
+				v.rfc3339(indexPath("$.history", i)+".created", *h.Created)
+			}
+			image.History = append(image.History, h.History)
+		}
+		v.image(image)
+	default:
+		v.add("$", "unsupported document media type %q", mediaType)
+	}
+	return v
+}
+
+// ValidateBlob returns the rules of the image spec broken by the document
+// data, described by desc: the descriptor itself, its size, digest and media
+// type matching the document, and the document.
+func ValidateBlob(desc Descriptor, data []byte) []Violation {
+	var v violations
+	for _, violation := range ValidateDescriptor(desc) {
+		violation.Path = "descriptor" + strings.TrimPrefix(violation.Path, "$")
+		v = append(v, violation)
+	}
+	if int64(len(data)) != desc.Size {
+		v.add("$", "is %d bytes, the descriptor size is %d", len(data), desc.Size)
+	}
+	if desc.Digest.Validate() == nil && desc.Digest.Algorithm().FromBytes(data) != desc.Digest {
+		v.add("$", "does not match the descriptor digest %v", desc.Digest)
+	}
+	var typed struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.NewDecoder(bytes.NewReader(data)).Decode(&typed) == nil && len(typed.MediaType) != 0 && typed.MediaType != desc.MediaType {
+		v.add("$.mediaType", "is %v, the descriptor media type is %v", typed.MediaType, desc.MediaType)
+	}
+	// The media type was already checked against the descriptor
+	for _, violation := range Validate(desc.MediaType, data) {
+		if violation.Path != "$.mediaType" || len(typed.MediaType) == 0 || typed.MediaType == desc.MediaType {
+			v = append(v, violation)
+		}
+	}
+	return v
+}
@@ -0,0 +1,191 @@
+package specs_test
+
+import (
+	"rocked/specs"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	validDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	validConfig = `{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + validDigest + `","size":2}`
+	validLayer  = `{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"` + validDigest + `","size":2}`
+)
+
+// Returns the paths of the violations
+func violationPaths(violations []specs.Violation) []string {
+	var paths []string
+	for _, v := range violations {
+		paths = append(paths, v.Path)
+	}
+	return paths
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		doc       string
+		want      []string
+	}{
+		{
+			"valid manifest",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":` + validConfig + `,"layers":[` + validLayer + `],
+			"annotations":{"org.opencontainers.image.created":"2024-05-01T10:00:00Z","org.opencontainers.image.title":"test"}}`,
+			nil,
+		},
+		{
+			"manifest without schema version and layers",
+			specs.MediaTypeImageManifest,
+			`{"config":` + validConfig + `}`,
+			[]string{"$.schemaVersion", "$.layers"},
+		},
+		{
+			"manifest with an empty layers",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"config":` + validConfig + `,"layers":[]}`,
+			[]string{"$.layers"},
+		},
+		{
+			"manifest with a wrong media type",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","config":` + validConfig + `,"layers":[` + validLayer + `]}`,
+			[]string{"$.mediaType"},
+		},
+		{
+			"docker manifest without media type",
+			specs.MediaTypeDockerManifest,
+			`{"schemaVersion":2,"config":` + validConfig + `,"layers":[` + validLayer + `]}`,
+			[]string{"$.mediaType"},
+		},
+		{
+			"manifest with broken descriptors",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"config":{"mediaType":"config","digest":"md5:d41d8cd98f00b204e9800998ecf8427e","size":2},
+			"layers":[{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:abc","size":-1,"urls":["relative/path"]}]}`,
+			[]string{"$.config.mediaType", "$.config.digest", "$.layers[0].digest", "$.layers[0].size", "$.layers[0].urls[0]"},
+		},
+		{
+			"image layers of a config",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"config":` + validConfig + `,"layers":[` + validConfig + `]}`,
+			[]string{"$.layers[0].mediaType"},
+		},
+		{
+			"artifact",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"artifactType":"application/vnd.example+type","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"` + validDigest + `","size":2,"data":"e30="},"layers":[]}`,
+			nil,
+		},
+		{
+			"artifact without type",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"` + validDigest + `","size":2,"data":"e30K"},"layers":[]}`,
+			[]string{"$.config.data", "$.artifactType"},
+		},
+		{
+			"bad annotations",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,"config":` + validConfig + `,"layers":[` + validLayer + `],
+			"annotations":{"org.opencontainers.image.created":"yesterday","org.opencontainers.image.source":"github.com/x","org.opencontainers.image.colour":"blue","com.example.key":"value"}}`,
+			[]string{`$.annotations["org.opencontainers.image.colour"]`, `$.annotations["org.opencontainers.image.created"]`, `$.annotations["org.opencontainers.image.source"]`},
+		},
+		{
+			"wrong JSON type",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":"2","config":` + validConfig + `,"layers":[]}`,
+			[]string{"$.schemaVersion"},
+		},
+		{
+			"invalid JSON",
+			specs.MediaTypeImageManifest,
+			`{"schemaVersion":2,`,
+			[]string{"$"},
+		},
+		{
+			"valid index",
+			specs.MediaTypeImageIndex,
+			`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + validDigest + `","size":2,
+			"platform":{"architecture":"amd64","os":"linux"},"annotations":{"org.opencontainers.image.ref.name":"localhost:5000/test/fedora:40"}}]}`,
+			nil,
+		},
+		{
+			"index without manifests",
+			specs.MediaTypeImageIndex,
+			`{"schemaVersion":1}`,
+			[]string{"$.schemaVersion", "$.manifests"},
+		},
+		{
+			"index with broken manifests",
+			specs.MediaTypeImageIndex,
+			`{"schemaVersion":2,"manifests":[{"digest":"` + validDigest + `","size":2,"platform":{"os":"linux"},
+			"annotations":{"org.opencontainers.image.ref.name":"bad name"}}]}`,
+			[]string{"$.manifests[0].mediaType", `$.manifests[0].annotations["org.opencontainers.image.ref.name"]`, "$.manifests[0].platform.architecture"},
+		},
+		{
+			"valid config",
+			specs.MediaTypeImageConfig,
+			`{"created":"2024-05-01T10:00:00.123456789Z","architecture":"amd64","os":"linux","config":{"Env":["PATH=/usr/bin"],"ExposedPorts":{"80/tcp":{}}},
+			"rootfs":{"type":"layers","diff_ids":["` + validDigest + `"]},"history":[{"created_by":"ADD"},{"created_by":"ENV","empty_layer":true}]}`,
+			nil,
+		},
+		{
+			"broken config",
+			specs.MediaTypeDockerConfig,
+			`{"created":"01/05/2024","os":"linux","config":{"Env":["PATH"],"ExposedPorts":{"http":{}}},
+			"rootfs":{"type":"tar","diff_ids":["sha256:0"]},"history":[{"created":"now"},{"created_by":"ENV"}]}`,
+			[]string{"$.created", "$.history[0].created", "$.architecture", "$.rootfs.type", "$.rootfs.diff_ids[0]", "$.history", "$.config.Env[0]", `$.config.ExposedPorts["http"]`},
+		},
+		{
+			"not a document",
+			specs.MediaTypeImageLayerGzip,
+			`{}`,
+			[]string{"$"},
+		},
+	}
+	for _, tt := range tests {
+		got := violationPaths(specs.Validate(tt.mediaType, []byte(tt.doc)))
+		if !slices.Equal(got, tt.want) {
+			t.Fatalf("%v: Validate returned the violations of %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateBlob(t *testing.T) {
+	data := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":` + validConfig + `,"layers":[` + validLayer + `]}`)
+	desc := specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	if violations := specs.ValidateBlob(desc, data); len(violations) != 0 {
+		t.Fatalf("ValidateBlob returned %v", violations)
+	}
+
+	// Described as an index
+	desc.MediaType = specs.MediaTypeImageIndex
+	got := violationPaths(specs.ValidateBlob(desc, data))
+	if !slices.Equal(got, []string{"$.mediaType", "$.manifests"}) {
+		t.Fatalf("ValidateBlob of a wrong media type returned the violations of %v", got)
+	}
+
+	desc = specs.Descriptor{MediaType: specs.MediaTypeImageManifest, Digest: "sha512:0", Size: -1}
+	violations := specs.ValidateBlob(desc, data)
+	got = violationPaths(violations)
+	if !slices.Equal(got, []string{"descriptor.digest", "descriptor.size", "$"}) {
+		t.Fatalf("ValidateBlob with a broken descriptor returned the violations of %v", got)
+	}
+	if !strings.Contains(violations[2].String(), "bytes") {
+		t.Fatalf("the size violation is %v", violations[2])
+	}
+}
+
+func TestValidateDescriptor(t *testing.T) {
+	if violations := specs.ValidateDescriptor(specs.DescriptorEmptyJSON); len(violations) != 0 {
+		t.Fatalf("ValidateDescriptor of the empty JSON descriptor returned %v", violations)
+	}
+	got := violationPaths(specs.ValidateDescriptor(specs.Descriptor{ArtifactType: "not a type"}))
+	if !slices.Equal(got, []string{"$.mediaType", "$.digest", "$.artifactType"}) {
+		t.Fatalf("ValidateDescriptor returned the violations of %v", got)
+	}
+}
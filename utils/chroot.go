@@ -9,7 +9,6 @@ import (
 	"log/slog"
 	"os"
 	"os/user"
-	"path/filepath"
 )
 
 func CleanupChrootDir(path string, create bool) (err error) {
@@ -64,44 +63,19 @@ func Gunzip(archive, dest string) error {
 // For now this supports only tar archives, no compression.
 func ExtractImage(archive, dest string) error {
 	slog.Debug("ExtractImage", "archive", archive, "dest", dest)
-	if !PathExists(dest) {
-		os.MkdirAll(dest, 0777)
-	}
 	reader, err := os.Open(archive)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
-	tar := tar.NewReader(reader)
-	for {
-		header, err := tar.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		path := filepath.Join(dest, header.Name)
-		entry_info := header.FileInfo()
-		if entry_info.IsDir() {
-			err := os.MkdirAll(path, entry_info.Mode())
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, entry_info.Mode())
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		_, err = io.Copy(file, tar)
-		if err != nil {
-			return err
-		}
+	return ExtractTar(reader, dest)
+}
 
-	}
-	return nil
+// Extract the tar stream read from reader into dest.
+// See ExtractLayer for the entries supported.
+func ExtractTar(reader io.Reader, dest string) error {
+	slog.Debug("ExtractTar", "dest", dest)
+	return extractTar(tar.NewReader(reader), dest, WhiteoutNone)
 }
 
 func IsRoot() bool {
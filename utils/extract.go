@@ -0,0 +1,374 @@
+package utils
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// The prefix of the PAX records holding the extended attributes
+	PAX_XATTR_PREFIX = "SCHILY.xattr."
+	// How the paths of an archive are resolved in its destination: as if it
+	// were the root directory, so neither ".." nor a symbolic link leads out
+	// of it.
+	EXTRACT_RESOLVE uint64 = unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS
+)
+
+// tarExtractor extracts a tar archive confined in its destination.
+// Every entry is created with the *at syscalls, relative to its parent
+// directory opened with openat2.
+type tarExtractor struct {
+	// The destination directory
+	root int
+	// Whether the owners and the privileged xattrs can be set
+	privileged bool
+	whiteouts  WhiteoutMode
+	// The entries of the archive, relative to the destination
+	extracted map[string]bool
+	// The directories, whose times are set once their content is extracted
+	dirs []*tar.Header
+}
+
+// Returns the device number of major and minor (see makedev in man 3 makedev)
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// Returns the path of name in the directory opened as dirfd, for the calls
+// without an *at variant
+func fdPath(dirfd int, name string) string {
+	return fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, name)
+}
+
+// Cleans the name of an entry, relative to the destination.
+// The absolute names are taken as relative, the ones going up from the
+// destination are rejected.
+func cleanEntryName(name string) (string, error) {
+	clean := filepath.Clean(strings.TrimLeft(name, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("the entry %q is outside the destination", name)
+	}
+	return clean, nil
+}
+
+// Opens the directory rel of the destination
+func (e *tarExtractor) openDir(rel string) (int, error) {
+	how := unix.OpenHow{Flags: unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC, Resolve: EXTRACT_RESOLVE}
+	for {
+		fd, err := unix.Openat2(e.root, rel, &how)
+		if err != unix.EINTR && err != unix.EAGAIN {
+			return fd, err
+		}
+	}
+}
+
+// Opens the directory rel of the destination, creating it and its parents
+// if missing
+func (e *tarExtractor) mkdirAll(rel string) (int, error) {
+	fd, err := e.openDir(rel)
+	if err != unix.ENOENT || rel == "." {
+		return fd, err
+	}
+	parent, err := e.mkdirAll(filepath.Dir(rel))
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(parent)
+	if err := unix.Mkdirat(parent, filepath.Base(rel), 0755); err != nil && err != unix.EEXIST {
+		return -1, err
+	}
+	return e.openDir(rel)
+}
+
+// Tells if name is a single entry of a directory, not itself nor its parent
+func isEntryName(name string) bool {
+	return len(name) != 0 && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// Removes name, whatever it is, from the directory dirfd.
+// A directory is emptied through the descriptors of its subdirectories, so
+// the removal never leaves dirfd.
+func removeAt(dirfd int, name string) error {
+	if !isEntryName(name) {
+		return fmt.Errorf("can't remove %q: not an entry of the directory", name)
+	}
+	err := unix.Unlinkat(dirfd, name, 0)
+	switch err {
+	case nil, unix.ENOENT:
+		return nil
+	case unix.EISDIR:
+	default:
+		return err
+	}
+	how := unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	fd, err := unix.Openat2(dirfd, name, &how)
+	if err != nil {
+		return err
+	}
+	names, err := readDirNames(fd)
+	if err == nil {
+		for _, n := range names {
+			if err = removeAt(fd, n); err != nil {
+				break
+			}
+		}
+	}
+	unix.Close(fd)
+	if err != nil {
+		return err
+	}
+	if err := unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR); err != nil && err != unix.ENOENT {
+		return err
+	}
+	return nil
+}
+
+// Returns the names of the entries of the directory dirfd
+func readDirNames(dirfd int) ([]string, error) {
+	fd, err := unix.Dup(dirfd)
+	if err != nil {
+		return nil, err
+	}
+	dir := os.NewFile(uintptr(fd), "")
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
+
+// Applies the whiteout file name, found in the directory parent.
+// In delete mode, the opaque directories are emptied of what the lower layers
+// put there: everything but the entries of the archive itself.
+func (e *tarExtractor) applyWhiteout(parent int, name string) error {
+	dir, base := filepath.Split(name)
+	if base == WhiteoutOpaque {
+		slog.Debug("applyWhiteout opaque", "dir", dir)
+		if e.whiteouts == WhiteoutOverlay {
+			return unix.Fsetxattr(parent, OverlayOpaqueXattr, []byte("y"), 0)
+		}
+		names, err := readDirNames(parent)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if e.extracted[filepath.Join(dir, n)] {
+				continue
+			}
+			if err := removeAt(parent, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	target := base[len(WhiteoutPrefix):]
+	if !isEntryName(target) {
+		return fmt.Errorf("invalid whiteout %q", name)
+	}
+	slog.Debug("applyWhiteout", "dir", dir, "target", target)
+	if err := removeAt(parent, target); err != nil {
+		return err
+	}
+	if e.whiteouts == WhiteoutOverlay {
+		return unix.Mknodat(parent, target, unix.S_IFCHR, 0)
+	}
+	return nil
+}
+
+// Extracts one entry of the archive, reading its content from r
+func (e *tarExtractor) extract(header *tar.Header, r io.Reader) error {
+	name, err := cleanEntryName(header.Name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		slog.Debug("extractTar skipping the root", "name", header.Name)
+		return nil
+	}
+	parent, err := e.mkdirAll(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parent)
+	base := filepath.Base(name)
+	if e.whiteouts != WhiteoutNone && strings.HasPrefix(base, WhiteoutPrefix) {
+		return e.applyWhiteout(parent, name)
+	}
+	e.extracted[name] = true
+	// An entry replaces what a previous one left at the same path, except
+	// for directories which are merged
+	var stat unix.Stat_t
+	if err := unix.Fstatat(parent, base, &stat, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		if header.Typeflag != tar.TypeDir || stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			if err := removeAt(parent, base); err != nil {
+				return err
+			}
+		}
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := unix.Mkdirat(parent, base, 0700); err != nil && err != unix.EEXIST {
+			return err
+		}
+		e.dirs = append(e.dirs, header)
+	case tar.TypeReg, tar.TypeRegA:
+		fd, err := unix.Openat(parent, base, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err != nil {
+			return err
+		}
+		file := os.NewFile(uintptr(fd), name)
+		_, err = io.Copy(file, r)
+		if errc := file.Close(); err == nil {
+			err = errc
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := unix.Symlinkat(header.Linkname, parent, base); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := cleanEntryName(header.Linkname)
+		if err != nil {
+			return err
+		}
+		targetParent, err := e.openDir(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		defer unix.Close(targetParent)
+		// A hard link shares the metadata of its target
+		return unix.Linkat(targetParent, filepath.Base(target), parent, base, 0)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(0600)
+		switch header.Typeflag {
+		case tar.TypeChar:
+			mode |= unix.S_IFCHR
+		case tar.TypeBlock:
+			mode |= unix.S_IFBLK
+		default:
+			mode |= unix.S_IFIFO
+		}
+		if err := unix.Mknodat(parent, base, mode, mkdev(header.Devmajor, header.Devminor)); err != nil {
+			// Devices can't be created without privileges
+			slog.Debug("extractTar skipping", "name", header.Name, "error", err)
+			return nil
+		}
+	default:
+		slog.Debug("extractTar skipping", "name", header.Name, "type", header.Typeflag)
+		return nil
+	}
+	if err := e.setMetadata(parent, base, header); err != nil {
+		return fmt.Errorf("setting the metadata of %v: %w", name, err)
+	}
+	return nil
+}
+
+// Sets the owner, the permissions, the xattrs and, but for directories, the
+// times of the entry name of the directory parent
+func (e *tarExtractor) setMetadata(parent int, name string, header *tar.Header) error {
+	if e.privileged {
+		if err := unix.Fchownat(parent, name, header.Uid, header.Gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+	// After the chown, which clears the setuid and setgid bits.
+	// The symbolic links have no permissions of their own.
+	if header.Typeflag != tar.TypeSymlink {
+		if err := unix.Fchmodat(parent, name, uint32(header.Mode&07777), 0); err != nil {
+			return err
+		}
+	}
+	// After the chown too, which clears security.capability
+	for key, value := range header.PAXRecords {
+		attr, ok := strings.CutPrefix(key, PAX_XATTR_PREFIX)
+		if !ok {
+			continue
+		}
+		err := unix.Lsetxattr(fdPath(parent, name), attr, []byte(value), 0)
+		if errors.Is(err, unix.ENOTSUP) || (errors.Is(err, unix.EPERM) && !e.privileged) {
+			slog.Debug("extractTar skipping xattr", "name", header.Name, "xattr", attr, "error", err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("setting the xattr %v: %w", attr, err)
+		}
+	}
+	if header.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setTimes(parent, name, header)
+}
+
+// Sets the access and modification times of the entry name of the directory
+// parent
+func setTimes(parent int, name string, header *tar.Header) error {
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(header.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(parent, name, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// Sets the times of the directories extracted, the deepest first
+func (e *tarExtractor) setDirTimes() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		name, _ := cleanEntryName(e.dirs[i].Name)
+		parent, err := e.openDir(filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		err = setTimes(parent, filepath.Base(name), e.dirs[i])
+		unix.Close(parent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extracts the entries of the tar archive tr into dest.
+// Directories, regular files, symbolic and hard links, devices and fifos are
+// extracted with their permissions, times, xattrs (e.g. security.capability
+// and the SELinux labels) and, when running as root, their owner.
+// No entry is written outside dest, whatever its name and the symbolic links
+// extracted before it.
+// The whiteout files are applied as told by whiteouts.
+func extractTar(tr *tar.Reader, dest string, whiteouts WhiteoutMode) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	root, err := unix.Open(dest, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dest, Err: err}
+	}
+	defer unix.Close(root)
+	e := &tarExtractor{
+		root:       root,
+		privileged: os.Geteuid() == 0,
+		whiteouts:  whiteouts,
+		extracted:  map[string]bool{},
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return e.setDirTimes()
+		}
+		if err != nil {
+			return err
+		}
+		if err := e.extract(header, tr); err != nil {
+			return fmt.Errorf("extracting %v: %w", header.Name, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"rocked/specs"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// How the whiteouts of a layer are applied
+type WhiteoutMode int
+
+const (
+	// The whiteout files are extracted as any other file
+	WhiteoutNone WhiteoutMode = iota
+	// The whiteouts are converted into overlayfs whiteouts, for layers
+	// mounted as their own overlay lower directory: a removed entry becomes
+	// a 0/0 character device and an opaque directory gets the
+	// trusted.overlay.opaque xattr.
+	WhiteoutOverlay
+	// The entries removed by the whiteouts are deleted from dest, for layers
+	// extracted on top of each other into a single directory.
+	WhiteoutDelete
+)
+
+const (
+	// The prefix of the whiteout files (see the OCI image layer spec)
+	WhiteoutPrefix = ".wh."
+	// The file marking its directory as opaque
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+	// The xattr marking an overlayfs directory as opaque
+	OverlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// Compression of the layer media types
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// LayerCompression returns the compression of a layer from its media type
+func LayerCompression(mediaType string) (string, error) {
+	switch mediaType {
+	case specs.MediaTypeImageLayer, specs.MediaTypeImageLayerNonDistributable, specs.MediaTypeDockerLayer:
+		return CompressionNone, nil
+	case specs.MediaTypeImageLayerGzip, specs.MediaTypeImageLayerNonDistributableGzip,
+		specs.MediaTypeDockerLayerGzip, specs.MediaTypeDockerForeignLayerGzip:
+		return CompressionGzip, nil
+	case specs.MediaTypeImageLayerZstd, specs.MediaTypeImageLayerNonDistributableZstd:
+		return CompressionZstd, nil
+	}
+	return "", fmt.Errorf("unsupported layer media type %q", mediaType)
+}
+
+// DecompressLayer returns a reader of the uncompressed content of a layer,
+// read from r and compressed as told by its media type.
+func DecompressLayer(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	compression, err := LayerCompression(mediaType)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// ProgressReader counts the bytes read through it, calling OnProgress with
+// the bytes read so far at most every Interval and once the reader is
+// exhausted.
+type ProgressReader struct {
+	Reader     io.Reader
+	Interval   time.Duration
+	OnProgress func(read int64, done bool)
+	read       int64
+	last       time.Time
+}
+
+func (p *ProgressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.read += int64(n)
+	if p.OnProgress != nil {
+		if err == io.EOF {
+			p.OnProgress(p.read, true)
+		} else if time.Since(p.last) >= p.Interval {
+			p.last = time.Now()
+			p.OnProgress(p.read, false)
+		}
+	}
+	return n, err
+}
+
+// DiffIDError is returned when the uncompressed content of a layer doesn't
+// match its diff ID
+type DiffIDError struct {
+	Want digest.Digest
+	Got  digest.Digest
+}
+
+func (e *DiffIDError) Error() string {
+	return fmt.Sprintf("the layer diff ID is %v, expected %v", e.Got, e.Want)
+}
+
+// ExtractLayer extracts the layer read from r, compressed as told by its
+// media type, into dest, applying its whiteouts as told by whiteouts.
+// The decompression is streamed, the layer is never stored uncompressed.
+// If diffID is set, the digest of the uncompressed layer is verified against
+// it, failing with a DiffIDError if it doesn't match.
+func ExtractLayer(r io.Reader, mediaType, dest string, whiteouts WhiteoutMode, diffID digest.Digest) error {
+	slog.Debug("ExtractLayer", "mediaType", mediaType, "dest", dest, "whiteouts", whiteouts, "diffID", diffID)
+	var digester digest.Digester
+	if len(diffID) != 0 {
+		if err := diffID.Validate(); err != nil {
+			return fmt.Errorf("invalid diff ID %q: %w", diffID, err)
+		}
+		digester = diffID.Algorithm().Digester()
+	}
+	decompressed, err := DecompressLayer(r, mediaType)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+	var uncompressed io.Reader = decompressed
+	if digester != nil {
+		uncompressed = io.TeeReader(decompressed, digester.Hash())
+	}
+	if err := extractTar(tar.NewReader(uncompressed), dest, whiteouts); err != nil {
+		return err
+	}
+	// Consume the padding at the end of the archive, so the compressed
+	// stream is read whole
+	if _, err := io.Copy(io.Discard, uncompressed); err != nil {
+		return err
+	}
+	if digester != nil && digester.Digest() != diffID {
+		return &DiffIDError{Want: diffID, Got: digester.Digest()}
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"rocked/specs"
+	"rocked/utils"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+func makeLayer(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644}, "ID=test"},
+		{tar.Header{Name: "etc/release", Typeflag: tar.TypeSymlink, Linkname: "os-release"}, ""},
+		{tar.Header{Name: "etc/hard", Typeflag: tar.TypeLink, Linkname: "etc/os-release"}, ""},
+		{tar.Header{Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, "#!/bin/sh"},
+	}
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func compress(t *testing.T, data []byte, mediaType string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch mediaType {
+	case specs.MediaTypeImageLayerGzip:
+		w = gzip.NewWriter(&buf)
+	case specs.MediaTypeImageLayerZstd:
+		var err error
+		if w, err = zstd.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		return data
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestExtractLayer(t *testing.T) {
+	layer := makeLayer(t)
+	for _, mediaType := range []string{
+		specs.MediaTypeImageLayer,
+		specs.MediaTypeImageLayerGzip,
+		specs.MediaTypeImageLayerZstd,
+		specs.MediaTypeImageLayerNonDistributableGzip,
+	} {
+		t.Run(mediaType, func(t *testing.T) {
+			blob := compress(t, layer, mediaType)
+			if mediaType == specs.MediaTypeImageLayerNonDistributableGzip {
+				blob = compress(t, layer, specs.MediaTypeImageLayerGzip)
+			}
+			dest := t.TempDir()
+			var read int64
+			r := &utils.ProgressReader{
+				Reader: bytes.NewReader(blob),
+				OnProgress: func(n int64, done bool) {
+					if done {
+						read = n
+					}
+				},
+			}
+			if err := utils.ExtractLayer(r, mediaType, dest, utils.WhiteoutNone, digest.FromBytes(layer)); err != nil {
+				t.Fatalf("ExtractLayer returned an error (%v)", err)
+			}
+			if read != int64(len(blob)) {
+				t.Fatalf("the progress reported %v bytes read, want %v", read, len(blob))
+			}
+			if data, err := os.ReadFile(filepath.Join(dest, "etc/release")); err != nil || string(data) != "ID=test" {
+				t.Fatalf("reading through the symlink got %q (%v)", data, err)
+			}
+			if data, err := os.ReadFile(filepath.Join(dest, "etc/hard")); err != nil || string(data) != "ID=test" {
+				t.Fatalf("reading the hard link got %q (%v)", data, err)
+			}
+			info, err := os.Stat(filepath.Join(dest, "usr/bin/tool"))
+			if err != nil || info.Mode().Perm() != 0755 {
+				t.Fatalf("usr/bin/tool has mode %v (%v), want 0755", info.Mode(), err)
+			}
+		})
+	}
+}
+
+func TestExtractLayerDiffIDMismatch(t *testing.T) {
+	layer := makeLayer(t)
+	blob := compress(t, layer, specs.MediaTypeImageLayerGzip)
+	// The digest of the compressed blob, not of the layer content
+	err := utils.ExtractLayer(bytes.NewReader(blob), specs.MediaTypeImageLayerGzip, t.TempDir(), utils.WhiteoutNone, digest.FromBytes(blob))
+	var derr *utils.DiffIDError
+	if !errors.As(err, &derr) || derr.Got != digest.FromBytes(layer) {
+		t.Fatalf("ExtractLayer returned %v, want a DiffIDError", err)
+	}
+}
+
+func TestExtractLayerUnsupported(t *testing.T) {
+	err := utils.ExtractLayer(bytes.NewReader(makeLayer(t)), "application/vnd.oci.image.layer.v1.tar+bzip2", t.TempDir(), utils.WhiteoutNone, "")
+	if err == nil {
+		t.Fatalf("ExtractLayer accepted an unsupported media type")
+	}
+}
+
+// Returns a tar archive with the given entries, in order: names ending with
+// a slash are directories, the others regular files
+func makeEntries(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestExtractLayerWhiteoutDelete(t *testing.T) {
+	dest := t.TempDir()
+	lower := makeEntries(t, "etc/", "etc/passwd", "etc/group", "opt/", "opt/old", "opt/sub/", "opt/sub/file")
+	upper := makeEntries(t, "etc/.wh.passwd", "opt/new", "opt/.wh..wh..opq", "tmp/.wh.missing")
+	for _, layer := range [][]byte{lower, upper} {
+		if err := utils.ExtractLayer(bytes.NewReader(layer), specs.MediaTypeImageLayer, dest, utils.WhiteoutDelete, ""); err != nil {
+			t.Fatalf("ExtractLayer returned an error (%v)", err)
+		}
+	}
+	for _, name := range []string{"etc/passwd", "etc/.wh.passwd", "opt/old", "opt/sub", "opt/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Fatalf("%v exists after applying the whiteouts (%v)", name, err)
+		}
+	}
+	// The opaque directory keeps the entries of its own layer
+	for _, name := range []string{"etc/group", "opt/new"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); err != nil {
+			t.Fatalf("%v was removed (%v)", name, err)
+		}
+	}
+}
+
+func TestExtractLayerWhiteoutInvalid(t *testing.T) {
+	for _, name := range []string{".wh...", ".wh..", ".wh.", "sub/.wh..."} {
+		for _, mode := range []utils.WhiteoutMode{utils.WhiteoutDelete, utils.WhiteoutOverlay} {
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "rootfs")
+			sibling := filepath.Join(parent, "sibling")
+			if err := os.MkdirAll(filepath.Join(dest, "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(sibling, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(sibling, "file"), []byte("keep"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			layer := makeEntries(t, name)
+			if err := utils.ExtractLayer(bytes.NewReader(layer), specs.MediaTypeImageLayer, dest, mode, ""); err == nil {
+				t.Fatalf("ExtractLayer accepted the whiteout %q", name)
+			}
+			for _, path := range []string{filepath.Join(sibling, "file"), filepath.Join(dest, "sub")} {
+				if _, err := os.Lstat(path); err != nil {
+					t.Fatalf("the whiteout %q removed %v (%v)", name, path, err)
+				}
+			}
+		}
+	}
+}
+
+func TestExtractLayerWhiteoutOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating overlay whiteouts requires root")
+	}
+	dest := t.TempDir()
+	layer := makeEntries(t, "etc/.wh.passwd", "opt/.wh..wh..opq")
+	if err := utils.ExtractLayer(bytes.NewReader(layer), specs.MediaTypeImageLayer, dest, utils.WhiteoutOverlay, ""); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) {
+			t.Skipf("the filesystem doesn't support overlay whiteouts (%v)", err)
+		}
+		t.Fatalf("ExtractLayer returned an error (%v)", err)
+	}
+	info, err := os.Lstat(filepath.Join(dest, "etc/passwd"))
+	if err != nil {
+		t.Fatalf("the whiteout device is missing (%v)", err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); info.Mode()&os.ModeCharDevice == 0 || stat.Rdev != 0 {
+		t.Fatalf("etc/passwd is %v (rdev %v), want a 0/0 character device", info.Mode(), stat.Rdev)
+	}
+	value := make([]byte, 8)
+	n, err := syscall.Getxattr(filepath.Join(dest, "opt"), utils.OverlayOpaqueXattr, value)
+	if err != nil || string(value[:n]) != "y" {
+		t.Fatalf("opt has %v=%q (%v), want y", utils.OverlayOpaqueXattr, value[:n], err)
+	}
+}
+
+// Extracts the archive made of headers (and their content) into a new
+// directory, returned with the error of the extraction
+func extractHeaders(t *testing.T, headers []tar.Header, content map[string]string) (string, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		hdr.Size = int64(len(content[hdr.Name]))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content[hdr.Name]))
+	}
+	tw.Close()
+	dest := filepath.Join(t.TempDir(), "rootfs")
+	return dest, utils.ExtractLayer(&buf, specs.MediaTypeImageLayer, dest, utils.WhiteoutNone, "")
+}
+
+func TestExtractLayerConfined(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []tar.Header
+		// Where the file lands in the destination, empty if rejected
+		want string
+	}{
+		{"dotdot", []tar.Header{{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}}, ""},
+		{"absolute", []tar.Header{{Name: "/etc/evil", Typeflag: tar.TypeReg, Mode: 0644}}, "etc/evil"},
+		{"symlink parent", []tar.Header{
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+			{Name: "up/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		}, "evil"},
+		{"absolute symlink parent", []tar.Header{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "conf", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+			{Name: "conf/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		}, "etc/evil"},
+		{"hardlink", []tar.Header{{Name: "evil", Typeflag: tar.TypeLink, Linkname: "../outside"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, err := extractHeaders(t, tt.headers, nil)
+			outside := filepath.Join(filepath.Dir(dest), "evil")
+			if _, serr := os.Lstat(outside); serr == nil {
+				t.Fatalf("the archive wrote %v", outside)
+			}
+			if len(tt.want) == 0 {
+				if err == nil {
+					t.Fatalf("ExtractLayer accepted an entry outside the destination")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExtractLayer returned an error (%v)", err)
+			}
+			if info, err := os.Lstat(filepath.Join(dest, tt.want)); err != nil || !info.Mode().IsRegular() {
+				t.Fatalf("%v is not a regular file (%v)", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestExtractLayerMetadata(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	headers := []tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime},
+		{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 04755, Uid: 1000, Gid: 1000, ModTime: mtime,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value"}},
+		{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "ping", ModTime: mtime},
+		{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0600, ModTime: mtime},
+	}
+	dest, err := extractHeaders(t, headers, map[string]string{"bin/ping": "ping"})
+	if err != nil {
+		t.Fatalf("ExtractLayer returned an error (%v)", err)
+	}
+	for _, name := range []string{"bin", "bin/ping", "bin/link", "fifo"} {
+		info, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatalf("Lstat of %v returned an error (%v)", name, err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Fatalf("%v was modified at %v, want %v", name, info.ModTime(), mtime)
+		}
+	}
+	info, _ := os.Lstat(filepath.Join(dest, "fifo"))
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("fifo has mode %v", info.Mode())
+	}
+	info, _ = os.Lstat(filepath.Join(dest, "bin/ping"))
+	if os.Geteuid() == 0 {
+		if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 1000 || stat.Gid != 1000 {
+			t.Fatalf("bin/ping is owned by %v:%v, want 1000:1000", stat.Uid, stat.Gid)
+		}
+		if info.Mode()&os.ModeSetuid == 0 {
+			t.Fatalf("bin/ping has mode %v, want setuid", info.Mode())
+		}
+	}
+	value := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(dest, "bin/ping"), "user.test", value)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return
+	}
+	if err != nil || string(value[:n]) != "value" {
+		t.Fatalf("bin/ping has user.test=%q (%v), want value", value[:n], err)
+	}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ExecUser is the user a container process runs as.
+type ExecUser struct {
+	Uid    int
+	Gid    int
+	Groups []int
+	Home   string
+}
+
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// Parses the colon separated lines of a passwd or group file.
+// A missing file is treated as an empty one.
+func readColonFile(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var lines [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Split(line, ":"))
+	}
+	return lines, scanner.Err()
+}
+
+func readPasswd(path string) ([]passwdEntry, error) {
+	lines, err := readColonFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []passwdEntry
+	for _, fields := range lines {
+		if len(fields) < 6 {
+			continue
+		}
+		uid, erru := strconv.Atoi(fields[2])
+		gid, errg := strconv.Atoi(fields[3])
+		if erru != nil || errg != nil {
+			continue
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]})
+	}
+	return entries, nil
+}
+
+func readGroup(path string) ([]groupEntry, error) {
+	lines, err := readColonFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []groupEntry
+	for _, fields := range lines {
+		if len(fields) < 4 {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		var members []string
+		if len(fields[3]) != 0 {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{name: fields[0], gid: gid, members: members})
+	}
+	return entries, nil
+}
+
+// ResolveUser resolves a user specification as found in the image config
+// (name, uid, name:group, uid:gid, ...) using the given passwd and group files.
+// An empty specification means root.
+// Numeric ids don't need to exist in the files; unknown names are an error.
+func ResolveUser(spec, passwdPath, groupPath string) (*ExecUser, error) {
+	users, err := readPasswd(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readGroup(groupPath)
+	if err != nil {
+		return nil, err
+	}
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	if len(userSpec) == 0 {
+		userSpec = "0"
+	}
+
+	execUser := &ExecUser{Home: "/"}
+	userName := ""
+	uid, err := strconv.Atoi(userSpec)
+	numeric := err == nil
+	found := false
+	for _, u := range users {
+		if (numeric && u.uid == uid) || (!numeric && u.name == userSpec) {
+			execUser.Uid = u.uid
+			execUser.Gid = u.gid
+			execUser.Home = u.home
+			userName = u.name
+			found = true
+			break
+		}
+	}
+	if !found {
+		if !numeric {
+			return nil, fmt.Errorf("unable to find user %v", userSpec)
+		}
+		if uid < 0 {
+			return nil, fmt.Errorf("invalid uid %v", uid)
+		}
+		execUser.Uid = uid
+	}
+
+	if hasGroup {
+		gid, err := strconv.Atoi(groupSpec)
+		if err != nil {
+			found = false
+			for _, g := range groups {
+				if g.name == groupSpec {
+					gid = g.gid
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unable to find group %v", groupSpec)
+			}
+		} else if gid < 0 {
+			return nil, fmt.Errorf("invalid gid %v", gid)
+		}
+		execUser.Gid = gid
+		// An explicit group replaces the supplementary ones
+		return execUser, nil
+	}
+
+	if len(userName) != 0 {
+		for _, g := range groups {
+			for _, member := range g.members {
+				if member == userName && g.gid != execUser.Gid {
+					execUser.Groups = append(execUser.Groups, g.gid)
+				}
+			}
+		}
+	}
+	return execUser, nil
+}
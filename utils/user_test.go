@@ -0,0 +1,82 @@
+package utils_test
+
+import (
+	"os"
+	"reflect"
+	"rocked/utils"
+	"testing"
+)
+
+func writeUserFiles(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	passwd := dir + "/passwd"
+	group := dir + "/group"
+	os.WriteFile(passwd, []byte(`root:x:0:0:root:/root:/bin/bash
+# a comment
+nginx:x:101:102:nginx:/var/lib/nginx:/sbin/nologin
+plambri:x:1000:1000::/home/plambri:/bin/bash
+`), 0644)
+	os.WriteFile(group, []byte(`root:x:0:
+wheel:x:10:plambri
+nginx:x:102:
+plambri:x:1000:
+docker:x:990:plambri,nginx
+`), 0644)
+	return passwd, group
+}
+
+func TestResolveUser(t *testing.T) {
+	passwd, group := writeUserFiles(t)
+	tests := []struct {
+		spec    string
+		want    utils.ExecUser
+		wantErr bool
+	}{
+		{"", utils.ExecUser{Uid: 0, Gid: 0, Home: "/root"}, false},
+		{"root", utils.ExecUser{Uid: 0, Gid: 0, Home: "/root"}, false},
+		{"plambri", utils.ExecUser{Uid: 1000, Gid: 1000, Groups: []int{10, 990}, Home: "/home/plambri"}, false},
+		{"101", utils.ExecUser{Uid: 101, Gid: 102, Groups: []int{990}, Home: "/var/lib/nginx"}, false},
+		{"nginx:wheel", utils.ExecUser{Uid: 101, Gid: 10, Home: "/var/lib/nginx"}, false},
+		{"2000:3000", utils.ExecUser{Uid: 2000, Gid: 3000, Home: "/"}, false},
+		{"2000", utils.ExecUser{Uid: 2000, Gid: 0, Home: "/"}, false},
+		{"nobody", utils.ExecUser{}, true},
+		{"nginx:nogroup", utils.ExecUser{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := utils.ResolveUser(tt.spec, passwd, group)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveUserMissingFiles(t *testing.T) {
+	got, err := utils.ResolveUser("1000:1000", "/nonexistent/passwd", "/nonexistent/group")
+	if err != nil {
+		t.Fatalf("ResolveUser returned an error (%v)", err)
+	}
+	if got.Uid != 1000 || got.Gid != 1000 {
+		t.Errorf("got %+v want uid 1000 and gid 1000", *got)
+	}
+}
+
+func TestLookPath(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/tool", []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(dir+"/notexec", []byte("data"), 0644)
+	got, err := utils.LookPath("tool", "/nonexistent:"+dir)
+	if err != nil || got != dir+"/tool" {
+		t.Errorf("got %v, %v want %v", got, err, dir+"/tool")
+	}
+	if _, err := utils.LookPath("notexec", dir); err == nil {
+		t.Errorf("LookPath found a non executable file")
+	}
+	if got, _ := utils.LookPath("/bin/sh", ""); got != "/bin/sh" {
+		t.Errorf("got %v want /bin/sh", got)
+	}
+}
@@ -1,7 +1,13 @@
 package utils
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -31,4 +37,69 @@ func IsVirtual(fs string) bool {
 	return false
 }
 
+// Looks for an executable in the directories listed in path (e.g. "/usr/bin:/bin").
+// A file containing a slash is returned as it is.
+func LookPath(file, path string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if len(dir) == 0 {
+			dir = "."
+		}
+		candidate := filepath.Join(dir, file)
+		info, err := os.Stat(candidate)
+		if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("executable %v not found in %v", file, path)
+}
+
+// Decodes the octal escapes (e.g. \040 for a space) used in /proc/self/mountinfo
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// Returns the mount points found in mountinfo (e.g. /proc/self/mountinfo) which
+// are path itself or below it, the deepest first, so they can be unmounted in order.
+func MountsUnder(mountinfo, path string) ([]string, error) {
+	file, err := os.Open(mountinfo)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	path = filepath.Clean(path)
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[4])
+		if mountPoint == path || strings.HasPrefix(mountPoint, path+"/") {
+			mounts = append(mounts, mountPoint)
+		}
+	}
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return len(mounts[i]) > len(mounts[j])
+	})
+	return mounts, scanner.Err()
+}
+
 // Prep a directory to be used as container
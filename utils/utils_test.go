@@ -2,6 +2,8 @@ package utils_test
 
 import (
 	"fmt"
+	"os"
+	"reflect"
 	"rocked/utils"
 	"testing"
 )
@@ -33,3 +35,42 @@ func TestUntarNonExistentArchive(t *testing.T) {
 		t.Fatalf("ExtractImage didn't return an error (%v) when the source archive doesn't exists", err)
 	}
 }
+
+func TestMountsUnder(t *testing.T) {
+	mountinfo := t.TempDir() + "/mountinfo"
+	os.WriteFile(mountinfo, []byte(`22 1 0:21 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+35 22 0:31 / /tmp/containers/abc/overlay/merge rw - overlay overlay rw
+36 35 0:5 / /tmp/containers/abc/overlay/merge/proc rw - proc proc rw
+37 35 0:6 / /tmp/containers/abc/overlay/merge/dev rw - devtmpfs devtmpfs rw
+38 22 0:32 / /tmp/containers/abcd rw - tmpfs tmpfs rw
+39 22 0:33 / /tmp/containers/abc/with\040space rw - tmpfs tmpfs rw
+`), 0644)
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/tmp/containers/abc", []string{
+			"/tmp/containers/abc/overlay/merge/proc",
+			"/tmp/containers/abc/overlay/merge/dev",
+			"/tmp/containers/abc/overlay/merge",
+			"/tmp/containers/abc/with space",
+		}},
+		{"/tmp/containers/abc/overlay/merge/", []string{
+			"/tmp/containers/abc/overlay/merge/proc",
+			"/tmp/containers/abc/overlay/merge/dev",
+			"/tmp/containers/abc/overlay/merge",
+		}},
+		{"/tmp/containers/xyz", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := utils.MountsUnder(mountinfo, tt.path)
+			if err != nil {
+				t.Fatalf("MountsUnder returned an error (%v)", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("MountsUnder(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}